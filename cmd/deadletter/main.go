@@ -0,0 +1,134 @@
+// The deadletter command inspects and re-drives the messages which the
+// directipserver could not deliver to a target.
+//
+//	deadletter -dir /var/lib/directip/deadletter list
+//	deadletter -dir /var/lib/directip/deadletter show <id>
+//	deadletter -dir /var/lib/directip/deadletter -config /etc/directip/config.yaml redrive [<id>...]
+//	deadletter -dir /var/lib/directip/deadletter remove <id>...
+//
+// The secrets and the header values of the targets are not stored with the
+// dead letters, so a redrive to a target with a secret or a header needs the
+// config of the directipserver.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/protegear/sbd/mux"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func main() {
+	dir := flag.String("dir", "", "the dead letter directory of the directipserver")
+	config := flag.String("config", "", "the config of the directipserver with the secrets and headers of the targets")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s -dir <directory> [-config <file>] list|show <id>|redrive [<id>...]|remove <id>...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *dir == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	dl, err := mux.OpenDeadLetters(*dir)
+	if err != nil {
+		fail(err)
+	}
+	log := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	switch cmd, ids := flag.Arg(0), flag.Args()[1:]; cmd {
+	case "list":
+		letters, err := dl.List()
+		if err != nil {
+			fail(err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tTIME\tTARGET\tIMEI\tATTEMPTS\tERROR")
+		for _, l := range letters {
+			imei := ""
+			if l.Data != nil && l.Data.Header != nil {
+				imei = l.Data.Header.GetIMEI()
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n", l.ID, l.Time.Format(time.RFC3339), l.Target.Backend, imei, l.Attempts, l.Error)
+		}
+		w.Flush()
+	case "show":
+		for _, id := range ids {
+			l, err := dl.Load(id)
+			if err != nil {
+				fail(err)
+			}
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.Encode(l)
+		}
+	case "redrive":
+		targets, err := readTargets(*config)
+		if err != nil {
+			fail(err)
+		}
+		var letters []*mux.DeadLetter
+		if len(ids) == 0 {
+			letters, err = dl.List()
+			if err != nil {
+				fail(err)
+			}
+		}
+		for _, id := range ids {
+			l, err := dl.Load(id)
+			if err != nil {
+				fail(err)
+			}
+			letters = append(letters, l)
+		}
+		failed := 0
+		for _, l := range letters {
+			if err := dl.Redrive(l, targets, log); err != nil {
+				log.Error("cannot redrive dead letter", "id", l.ID, "target", l.Target.Backend, "error", err)
+				failed++
+				continue
+			}
+			log.Info("redrive dead letter", "id", l.ID, "target", l.Target.Backend)
+		}
+		if failed > 0 {
+			os.Exit(1)
+		}
+	case "remove":
+		for _, id := range ids {
+			if err := dl.Remove(id); err != nil {
+				fail(err)
+			}
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// readTargets reads the targets of the config file, no file means no
+// targets.
+func readTargets(name string) (mux.Targets, error) {
+	if name == "" {
+		return nil, nil
+	}
+	content, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read config file: %v", err)
+	}
+	var targets mux.Targets
+	if err := yaml.Unmarshal(content, &targets); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal config file: %v", err)
+	}
+	return targets, nil
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
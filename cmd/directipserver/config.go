@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/protegear/sbd/mux"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// the events of a file change often come in bursts, so we wait a moment
+// before the file is read.
+const reloadDelay = 200 * time.Millisecond
+
+// A targetSet combines the targets of the config file and the targets of
+// the annotated kubernetes services, so a reload of the config file keeps
+// the services and vice versa.
+type targetSet struct {
+	mu       sync.Mutex
+	dist     mux.Distributer
+	file     mux.Targets
+	services mux.Targets
+}
+
+func (s *targetSet) apply(file, services mux.Targets) error {
+	targets := append(append(mux.Targets{}, file...), services...)
+	if err := s.dist.WithTargets(targets); err != nil {
+		return err
+	}
+	s.file, s.services = file, services
+	return nil
+}
+
+// setFile replaces the targets of the config file.
+func (s *targetSet) setFile(targets mux.Targets) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.apply(targets, s.services)
+}
+
+// setService adds or replaces the target of the service with the given
+// id. A nil target removes the service.
+func (s *targetSet) setService(id string, t *mux.Target) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var services mux.Targets
+	for _, st := range s.services {
+		if st.ID != id {
+			services = append(services, st)
+		}
+	}
+	if t != nil {
+		services = append(services, *t)
+	}
+	return s.apply(s.file, services)
+}
+
+// readConfig reads the targets from the config file.
+func readConfig(name string) (mux.Targets, []byte, error) {
+	content, err := os.ReadFile(name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot read config file: %v", err)
+	}
+	var targets mux.Targets
+	if err := yaml.Unmarshal(content, &targets); err != nil {
+		return nil, nil, fmt.Errorf("cannot unmarshal config file: %v", err)
+	}
+	return targets, content, nil
+}
+
+// watchConfig reloads the config file when it changes or when the service
+// receives a SIGHUP. The directory is watched because kubernetes replaces
+// the mounted ConfigMap by switching a symlink. An invalid config is
+// logged and the running config is kept.
+func watchConfig(ctx context.Context, log *slog.Logger, name string, current []byte, set *targetSet) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var events chan fsnotify.Event
+	var errs chan error
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Error("cannot watch config file, reload only on SIGHUP", "config", name, "error", err)
+	} else {
+		defer w.Close()
+		if err := w.Add(filepath.Dir(name)); err != nil {
+			log.Error("cannot watch config file, reload only on SIGHUP", "config", name, "error", err)
+		} else {
+			events, errs = w.Events, w.Errors
+		}
+	}
+
+	reload := func(force bool) {
+		targets, content, err := readConfig(name)
+		if err != nil {
+			configReloads.WithLabelValues("failed").Inc()
+			log.Error("cannot reload config, keep the running config", "config", name, "error", err)
+			return
+		}
+		if !force && bytes.Equal(content, current) {
+			return
+		}
+		if err := set.setFile(targets); err != nil {
+			configReloads.WithLabelValues("failed").Inc()
+			log.Error("invalid config, keep the running config", "config", name, "error", err)
+			return
+		}
+		current = content
+		configReloads.WithLabelValues("success").Inc()
+		log.Info("reload configuration", "config", name, "targets", targets)
+	}
+
+	timer := time.NewTimer(reloadDelay)
+	timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			reload(true)
+		case ev := <-events:
+			// kubernetes updates the ..data symlink of the mounted ConfigMap
+			if n := filepath.Base(ev.Name); n == filepath.Base(name) || n == "..data" {
+				timer.Reset(reloadDelay)
+			}
+		case <-timer.C:
+			reload(false)
+		case err := <-errs:
+			log.Error("cannot watch config file", "config", name, "error", err)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/protegear/sbd/mux"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	oneTarget = `
+- imeipattern: .*
+  backend: http://localhost:8080/a
+`
+	twoTargets = `
+- imeipattern: .*
+  backend: http://localhost:8080/a
+- imeipattern: ^30
+  backend: http://localhost:8080/b
+`
+	invalidYAML    = "- imeipattern: [\n"
+	invalidPattern = `
+- imeipattern: "("
+  backend: http://localhost:8080/a
+`
+)
+
+func waitFor(cond func() bool) bool {
+	for i := 0; i < 50; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return false
+}
+
+func reloads(result string) float64 {
+	return testutil.ToFloat64(configReloads.WithLabelValues(result))
+}
+
+func TestWatchConfig(t *testing.T) {
+	Convey("given a watched config file", t, func() {
+		log := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError}))
+		dist := mux.New(1, log)
+		defer dist.Close()
+		set := &targetSet{dist: dist}
+		name := filepath.Join(t.TempDir(), "config.yaml")
+		write := func(content string) {
+			So(os.WriteFile(name, []byte(content), 0o600), ShouldBeNil)
+		}
+		write(oneTarget)
+		targets, content, err := readConfig(name)
+		So(err, ShouldBeNil)
+		So(set.setFile(targets), ShouldBeNil)
+		So(set.setService("svc", &mux.Target{ID: "svc", IMEIPattern: ".*", Backend: "http://localhost:8080/svc"}), ShouldBeNil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go watchConfig(ctx, log, name, content, set)
+		// the file is written until the started watcher reloads it
+		success := reloads("success")
+		started := false
+		for i := 0; i < 10 && !started; i++ {
+			write(twoTargets)
+			started = waitFor(func() bool { return reloads("success") == success+1 })
+		}
+		So(started, ShouldBeTrue)
+		So(dist.Targets(), ShouldHaveLength, 3)
+
+		Convey("a burst of changes should be reloaded once", func() {
+			success := reloads("success")
+			for _, c := range []string{oneTarget, twoTargets, oneTarget} {
+				write(c)
+			}
+			So(waitFor(func() bool { return len(dist.Targets()) == 2 }), ShouldBeTrue)
+			time.Sleep(2 * reloadDelay)
+			So(reloads("success"), ShouldEqual, success+1)
+		})
+		Convey("an invalid file should keep the running targets", func() {
+			for _, c := range []string{invalidYAML, invalidPattern} {
+				failed := reloads("failed")
+				write(c)
+				So(waitFor(func() bool { return reloads("failed") == failed+1 }), ShouldBeTrue)
+				So(dist.Targets(), ShouldHaveLength, 3)
+			}
+
+			Convey("and the unchanged valid file should not be reloaded", func() {
+				success := reloads("success")
+				write(twoTargets)
+				time.Sleep(3 * reloadDelay)
+				So(reloads("success"), ShouldEqual, success)
+				So(dist.Targets(), ShouldHaveLength, 3)
+			})
+		})
+		Convey("a SIGHUP should reload the unchanged file", func() {
+			success := reloads("success")
+			So(syscall.Kill(os.Getpid(), syscall.SIGHUP), ShouldBeNil)
+			So(waitFor(func() bool { return reloads("success") == success+1 }), ShouldBeTrue)
+			So(dist.Targets(), ShouldHaveLength, 3)
+		})
+	})
+}
@@ -2,18 +2,24 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
+	_ "time/tzdata" // for the timezones in the match rules
 
 	"github.com/lmittmann/tint"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/protegear/sbd"
 	"github.com/protegear/sbd/mux"
-	yaml "gopkg.in/yaml.v2"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/watch"
@@ -37,12 +43,25 @@ var (
 
 func main() {
 	config := flag.String("config", "", "specify the configuration for your forwarding rules")
-	health := flag.String("health", "127.0.0.1:2023", "the healtcheck URL (http)")
+	health := flag.String("health", "127.0.0.1:2023", "the healtcheck URL (http), metrics are served on /metrics")
 	stage := flag.String("stage", "test", "the name of the stage where this service is running")
 	loglevel := flag.String("loglevel", "info", "the loglevel, debug|info|warn|error|crit")
 	logformat := flag.String("logformat", "json", "the logformat, fmt|json|term")
 	workers := flag.Int("workers", 5, "the number of workers")
+	backlog := flag.Int("backlog", 0, "the number of messages which wait for a free worker")
+	background := flag.Int("background", 0, "the number of best effort deliveries which run in the background, 0 uses the number of workers")
+	overflow := flag.String("overflow", "hold", "hold the connection or reject the message (hold|reject) if the workers or a target are busy")
 	useproxyprotocol := flag.Bool("proxyprotocol", false, "use the proxyprotocol on the listening socket")
+	queuedir := flag.String("queue", "", "the directory of the queue; if set, every message is stored and acknowledged before it is delivered")
+	queueattempts := flag.Int("queueattempts", 50, "the number of deliveries of a queued message before it is moved to the failed entries (about four hours with the backoff), 0 retries until it succeeds")
+	ackpolicy := flag.String("ackpolicy", "all", "acknowledge a message if all|any|primary-only|quorum|none of the matching targets succeed")
+	quorum := flag.Int("quorum", 1, "the number of targets which must succeed with the ack policy quorum")
+	routing := flag.String("routing", "fanout", "deliver a message to all matching targets (fanout) or only to the first one (first-match)")
+	deadletters := flag.String("deadletter", "", "the directory for messages which cannot be delivered after all retries")
+	dedup := flag.Int("dedup", 0, "the number of delivered messages which are remembered to drop duplicates, 0 disables deduplication")
+	dedupfile := flag.String("dedupfile", "", "the file where the remembered messages are stored")
+	strict := flag.Bool("strict", false, "reject malformed messages and messages without a MO header")
+	shutdowntimeout := flag.Duration("shutdowntimeout", 30*time.Second, "the time to wait for running connections when stopping")
 
 	flag.Parse()
 
@@ -56,48 +75,121 @@ func main() {
 	}
 
 	log.Info("start service", "revision", revision, "builddate", builddate, "listen", listen)
-	distribution = mux.New(*workers, log)
-	if *config != "" {
-		cfg, err := os.Open(*config)
+	policy, err := mux.ParseAckPolicy(*ackpolicy)
+	if err != nil {
+		log.Error("cannot use ack policy", "error", err)
+		os.Exit(1)
+	}
+	rt, err := mux.ParseRouting(*routing)
+	if err != nil {
+		log.Error("cannot use routing", "error", err)
+		os.Exit(1)
+	}
+	ov, err := mux.ParseOverflow(*overflow)
+	if err != nil {
+		log.Error("cannot use overflow", "error", err)
+		os.Exit(1)
+	}
+	opts := []mux.Option{mux.WithAckPolicy(policy), mux.WithQuorum(*quorum), mux.WithRouting(rt), mux.WithOverflow(ov), mux.WithQueueSize(*backlog), mux.WithBackgroundSize(*background)}
+	if *deadletters != "" {
+		dl, err := mux.OpenDeadLetters(*deadletters)
 		if err != nil {
-			log.Error("cannot open config file", "config", *config, "error", err)
+			log.Error("cannot open dead letters", "deadletter", *deadletters, "error", err)
 			os.Exit(1)
 		}
-
-		var targets mux.Targets
-		err = yaml.NewDecoder(cfg).Decode(&targets)
+		opts = append(opts, mux.WithDeadLetters(dl))
+	}
+	distribution = mux.New(*workers, log, opts...)
+	targets := &targetSet{dist: distribution}
+	var configContent []byte
+	if *config != "" {
+		cfg, content, err := readConfig(*config)
 		if err != nil {
-			log.Error("cannot unmarshal data", "error", err)
+			log.Error("cannot load config", "config", *config, "error", err)
 			os.Exit(1)
 		}
-		err = distribution.WithTargets(targets)
+		err = targets.setFile(cfg)
 		if err != nil {
 			log.Error("cannot use config", "error", err)
 			os.Exit(1)
 		}
-		log.Info("change configuration", "targets", targets)
+		configContent = content
+		log.Info("change configuration", "targets", cfg)
+	}
+	if *queuedir != "" {
+		q, err := mux.NewQueued(distribution, *queuedir, *workers, log, mux.WithMaxAttempts(*queueattempts))
+		if err != nil {
+			log.Error("cannot open queue", "queue", *queuedir, "error", err)
+			os.Exit(1)
+		}
+		distribution = q
+	}
+	if *dedup > 0 {
+		d, err := mux.NewDeduplicated(distribution, *dedup, *dedupfile, log)
+		if err != nil {
+			log.Error("cannot create deduplication", "error", err)
+			os.Exit(1)
+		}
+		distribution = d
 	}
 
-	ctx := context.Background()
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer cancel()
 	client, err := rest.InClusterConfig()
 	if err != nil {
 		log.Info("no incluster config, assume standalone mode")
 	} else {
 		log.Info("incluster config found, assume kubernetes mode")
-		go watchServices(ctx, log, client, distribution)
+		go watchServices(ctx, log, client, targets)
+	}
+	if *config != "" {
+		go watchConfig(ctx, log, *config, configContent, targets)
 	}
 
-	go runHealth(*health)
-	sbd.NewService(log, listen, sbd.Logger(log, distribution), *useproxyprotocol)
+	registerMetrics(prometheus.DefaultRegisterer)
+	go runHealth(*health, distribution)
+	srv := &sbd.Server{
+		Addr:          listen,
+		Handler:       sbd.Logger(log, countOutcome(distribution)),
+		Log:           log,
+		ProxyProtocol: *useproxyprotocol,
+		ParseOptions:  sbd.ParseOptions{Strict: *strict},
+		OnAccept:      countAccepted,
+		OnParseError:  countParseError,
+	}
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		<-ctx.Done()
+		log.Info("shutdown service", "timeout", *shutdowntimeout)
+		sctx, scancel := context.WithTimeout(context.Background(), *shutdowntimeout)
+		defer scancel()
+		if err := srv.Shutdown(sctx); err != nil {
+			log.Error("cannot drain connections", "error", err)
+		}
+	}()
+	if err := srv.ListenAndServe(context.Background()); err != sbd.ErrServerClosed {
+		log.Error("cannot serve", "error", err)
+		os.Exit(1)
+	}
+	<-drained
+	distribution.Close()
 }
 
-func runHealth(health string) {
-	http.ListenAndServe(health, http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+func runHealth(health string, dist mux.Distributer) {
+	hm := http.NewServeMux()
+	hm.Handle("/metrics", promhttp.Handler())
+	hm.HandleFunc("/targets", func(rw http.ResponseWriter, rq *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(dist.Health())
+	})
+	hm.HandleFunc("/", func(rw http.ResponseWriter, rq *http.Request) {
 		fmt.Fprintf(rw, "OK")
-	}))
+	})
+	http.ListenAndServe(health, hm)
 }
 
-func watchServices(ctx context.Context, log *slog.Logger, client *rest.Config, s mux.Distributer) {
+func watchServices(ctx context.Context, log *slog.Logger, client *rest.Config, targets *targetSet) {
 	clientset, err := kubernetes.NewForConfig(client)
 	if err != nil {
 		log.Error("cannot create clientset for services", "error", err)
@@ -113,56 +205,26 @@ func watchServices(ctx context.Context, log *slog.Logger, client *rest.Config, s
 
 	for event := range watcher.ResultChan() {
 		svc := event.Object.(*v1.Service)
-		targets := s.Targets()
-		if event.Type == watch.Added {
+		id := string(svc.ObjectMeta.UID)
+		switch event.Type {
+		case watch.Added, watch.Modified:
 			t := targetFromService(svc)
-			if t != nil {
-				targets = append(targets, *t)
-				err = s.WithTargets(targets)
-				if err != nil {
-					log.Error("cannot change targets", "error", err)
-				} else {
-					log.Info("added new target", "targets", targets)
-				}
-			}
-		} else if event.Type == watch.Deleted {
-			var tgs []mux.Target
-			for _, t := range targets {
-				if t.ID == string(svc.ObjectMeta.UID) {
-					continue
-				}
-				tgs = append(tgs, t)
+			if t == nil {
+				continue
 			}
-			err = s.WithTargets(tgs)
-			if err != nil {
+			if err := targets.setService(id, t); err != nil {
 				log.Error("cannot change targets", "error", err)
 			} else {
-				log.Info("deleted target", "targets", targets)
+				log.Info("set service target", "service", svc.Name, "target", mux.Targets{*t})
 			}
-
-		} else if event.Type == watch.Modified {
-			t := targetFromService(svc)
-			if t != nil {
-				var tgs []mux.Target
-				for _, tt := range targets {
-					if tt.ID == string(svc.ObjectMeta.UID) {
-						tgs = append(tgs, *t)
-					} else {
-						tgs = append(tgs, tt)
-					}
-				}
-				err = s.WithTargets(tgs)
-				if err != nil {
-					log.Error("cannot change targets", "error", err)
-				} else {
-					log.Info("modifiedtarget", "targets", targets)
-				}
-
+		case watch.Deleted:
+			if err := targets.setService(id, nil); err != nil {
+				log.Error("cannot change targets", "error", err)
+			} else {
+				log.Info("deleted service target", "service", svc.Name)
 			}
 		}
-
 	}
-
 }
 
 func targetFromService(s *v1.Service) *mux.Target {
@@ -184,6 +246,17 @@ func targetFromService(s *v1.Service) *mux.Target {
 				ID:          string(s.ObjectMeta.UID),
 				Backend:     fmt.Sprintf("http://%s:%s%s", ip, port, path),
 				IMEIPattern: t,
+				Final:       a["protegear.io/directip-final"] == "true",
+			}
+			if prio, ok := a["protegear.io/directip-priority"]; ok {
+				p, err := strconv.Atoi(prio)
+				if err != nil {
+					// a wrong priority would change the routing order, so the
+					// service is skipped and a previous target is kept
+					slog.Error("invalid priority annotation, skip service", "service", mt.Name, "priority", prio, "error", err)
+					return nil
+				}
+				bk.Priority = p
 			}
 			return &bk
 		}
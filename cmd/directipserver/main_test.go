@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestTargetFromService(t *testing.T) {
+	service := func(priority string) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "tracker",
+				UID:  "uid",
+				Annotations: map[string]string{
+					"protegear.io/directip-imei":     "^30",
+					"protegear.io/directip-priority": priority,
+				},
+			},
+			Spec: v1.ServiceSpec{ClusterIP: "10.0.0.1"},
+		}
+	}
+	Convey("a service with a priority should be a target", t, func() {
+		tg := targetFromService(service("10"))
+		So(tg, ShouldNotBeNil)
+		So(tg.Priority, ShouldEqual, 10)
+		So(tg.Backend, ShouldEqual, "http://10.0.0.1:8080/")
+	})
+	Convey("a service with an invalid priority should be skipped", t, func() {
+		So(targetFromService(service("high")), ShouldBeNil)
+	})
+}
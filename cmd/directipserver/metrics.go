@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/protegear/sbd"
+	"github.com/protegear/sbd/mux"
+)
+
+var (
+	connectionsAccepted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "directip_connections_accepted_total",
+		Help: "The number of accepted directip connections.",
+	})
+	parseErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "directip_parse_errors_total",
+		Help: "The number of messages which could not be parsed by reason.",
+	}, []string{"reason"})
+	handledMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "directip_messages_handled_total",
+		Help: "The number of handled messages by outcome (ack, nack).",
+	}, []string{"outcome"})
+	configReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "directip_config_reloads_total",
+		Help: "The number of reloads of the config file by result (success, failed).",
+	}, []string{"result"})
+)
+
+func registerMetrics(r prometheus.Registerer) {
+	r.MustRegister(connectionsAccepted, parseErrors, handledMessages, configReloads)
+	r.MustRegister(mux.Collectors()...)
+}
+
+func countAccepted(net.Conn) {
+	connectionsAccepted.Inc()
+}
+
+func countParseError(err error) {
+	parseErrors.WithLabelValues(parseErrorReason(err)).Inc()
+}
+
+func parseErrorReason(err error) string {
+	var pe *sbd.ParseError
+	var ne net.Error
+	switch {
+	case errors.As(err, &pe) && pe.Kind != "":
+		return string(pe.Kind)
+	case errors.As(err, &pe):
+		return "invalid_message"
+	case errors.As(err, &ne) && ne.Timeout():
+		return "timeout"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "truncated"
+	}
+	return "other"
+}
+
+// countOutcome is a middleware which counts the positive and negative
+// acknowledges of the next handler.
+func countOutcome(next sbd.Handler) sbd.Handler {
+	return sbd.HandlerFunc(func(data *sbd.InformationBucket) error {
+		err := next.Handle(data)
+		if err != nil {
+			handledMessages.WithLabelValues("nack").Inc()
+		} else {
+			handledMessages.WithLabelValues("ack").Inc()
+		}
+		return err
+	})
+}
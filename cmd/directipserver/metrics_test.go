@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/protegear/sbd"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const moHeader = "\x01\x00\x1cp\xec\ai300234063904190\x00\x00K\x00\x00U\x9e\xba,"
+
+func parseError(msg string) error {
+	_, err := sbd.ParseElements(bytes.NewBufferString(msg), sbd.ParseOptions{Strict: true})
+	return err
+}
+
+func TestParseErrorReason(t *testing.T) {
+	Convey("the reason of a parse error should be its kind", t, func() {
+		So(parseErrorReason(parseError("\x02\x00\x00")), ShouldEqual, "protocol_version")
+		So(parseErrorReason(parseError("\x01\x00\x03\x01\x00\x1c")), ShouldEqual, "truncated_element")
+		So(parseErrorReason(parseError("\x01\x00\x1e\x01\x00\x1b"+moHeader[3:30])), ShouldEqual, "element_length")
+		So(parseErrorReason(parseError("\x01\x00\x3e"+moHeader+moHeader)), ShouldEqual, "duplicate_element")
+		So(parseErrorReason(parseError("\x01\x00\x07\x02\x00\x04test")), ShouldEqual, "missing_header")
+	})
+	Convey("other errors should be classified", t, func() {
+		So(parseErrorReason(parseError("\x01")), ShouldEqual, "truncated")
+		So(parseErrorReason(io.EOF), ShouldEqual, "truncated")
+		So(parseErrorReason(os.ErrDeadlineExceeded), ShouldEqual, "timeout")
+		So(parseErrorReason(errors.New("boom")), ShouldEqual, "other")
+	})
+	Convey("a parse error should be counted by its reason", t, func() {
+		before := testutil.ToFloat64(parseErrors.WithLabelValues("duplicate_element"))
+		countParseError(parseError("\x01\x00\x3e" + moHeader + moHeader))
+		So(testutil.ToFloat64(parseErrors.WithLabelValues("duplicate_element")), ShouldEqual, before+1)
+	})
+}
@@ -1,7 +1,7 @@
 package sbd
 
 import (
-	"encoding/binary"
+	"errors"
 	"log"
 	"net"
 )
@@ -21,9 +21,8 @@ func onError(e error) {
 // and parses the incoming directip messages. Set the Handler-Field
 // to implement your wanted behaviour. The default is simply logging.
 type DIPServer struct {
-	address      string
-	listener     net.Listener
-	confirmation confirmationMessage
+	address  string
+	listener net.Listener
 
 	Handle  DIPHandler
 	OnError func(error)
@@ -38,57 +37,20 @@ func (ts *DIPServer) start() {
 			}
 			go func(con net.Conn) {
 				defer con.Close()
-				var res MessageHeader
-				if err := binary.Read(con, binary.BigEndian, &res); err != nil {
+				msg, err := ParseMTMessage(con)
+				if err != nil {
 					ts.OnError(err)
 					return
 				}
-				var dih mtDirectIPHeader
-				if err := binary.Read(con, binary.BigEndian, &dih); err != nil {
-					ts.OnError(err)
+				if msg.Header == nil {
+					ts.OnError(errors.New("the message contains no MT header"))
 					return
 				}
-				read := binary.Size(dih)
-				var data []byte
-				var prio *int
-				for read < int(res.MessageLength) {
-					var ph Header
-					if err := binary.Read(con, binary.BigEndian, &ph); err != nil {
-						ts.OnError(err)
-						return
-					}
-					if ph.ID == mtPayloadID {
-						data = make([]byte, ph.ElementLength)
-						if _, err := con.Read(data); err != nil {
-							ts.OnError(err)
-							return
-						}
-						read += int(ph.ElementLength) + binary.Size(ph)
-					}
-					if ph.ID == mtMessagePriority {
-						var mtp mtPriority
-						if err := binary.Read(con, binary.BigEndian, &mtp); err != nil {
-							ts.OnError(err)
-							return
-						}
-						read += binary.Size(mtp)
-						i := int(mtp.Level)
-						prio = &i
-					}
-				}
-				conf := ts.Handle(&res, &dih.DirectIPHeader, data, prio)
-				confgMsg := confirmationMessage{
-					MessageHeader: MessageHeader{
-						ProtocolRevision: protocolRevision,
-						MessageLength:    25,
-					},
-					Header: Header{
-						ID:            mtConfirmationMsg,
-						ElementLength: 25,
-					},
-					Confirmation: conf,
+				conf := ts.Handle(&msg.MessageHeader, msg.Header, msg.Payload, msg.Priority)
+				res := MTMessage{Confirmation: &conf}
+				if err := res.Encode(con); err != nil {
+					ts.OnError(err)
 				}
-				binary.Write(con, binary.BigEndian, &confgMsg)
 			}(con)
 		}
 	}()
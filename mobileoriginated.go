@@ -0,0 +1,58 @@
+package sbd
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// SendMO acts like the iridium gateway: it dials the directip receiver at
+// the given address, sends the bucket as a MO message and reads the
+// confirmation. Use the Success method of the returned confirmation to
+// check if the receiver acknowledged the message. The context is honoured
+// while dialing, writing and reading.
+func SendMO(ctx context.Context, serverAddress string, b *InformationBucket) (*MOConfirmationMessage, error) {
+	msg, err := Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+	return SendRawMO(ctx, serverAddress, msg)
+}
+
+// SendRawMO is like SendMO but sends the given bytes unchanged, e.g. the
+// Raw message of a received bucket to relay it byte by byte.
+func SendRawMO(ctx context.Context, serverAddress string, msg []byte) (*MOConfirmationMessage, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", serverAddress)
+	if err != nil {
+		return nil, fmt.Errorf("cannot dial %q: %v", serverAddress, err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	if _, err := conn.Write(msg); err != nil {
+		return nil, fmt.Errorf("cannot write data to connection: %w", contextError(ctx, err))
+	}
+	var res result
+	if err := binary.Read(conn, binary.BigEndian, &res); err != nil {
+		return nil, fmt.Errorf("cannot read MO confirmation: %w", contextError(ctx, err))
+	}
+	if res.ID != MOConfirmationID {
+		return nil, fmt.Errorf("unexpected informationelement %#x in MO confirmation", byte(res.ID))
+	}
+	return &res.MOConfirmationMessage, nil
+}
+
+// contextError returns the error of the context if it is done, so
+// callers see the cancellation and not the resulting i/o timeout.
+func contextError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
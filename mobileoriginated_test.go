@@ -0,0 +1,69 @@
+package sbd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSendMO(t *testing.T) {
+	Convey("given a running server", t, func() {
+		var received *InformationBucket
+		fail := false
+		srv := &Server{
+			Handler: HandlerFunc(func(data *InformationBucket) error {
+				received = data
+				if fail {
+					return errors.New("failed")
+				}
+				return nil
+			}),
+		}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		go srv.Serve(context.Background(), l)
+		defer srv.Shutdown(context.Background())
+
+		el, err := GetElements(bytes.NewBufferString(sample_msg1))
+		So(err, ShouldBeNil)
+
+		Convey("a handled message should be acknowledged", func() {
+			conf, err := SendMO(context.Background(), l.Addr().String(), el)
+			So(err, ShouldBeNil)
+			So(conf.Success(), ShouldBeTrue)
+			So(received, ShouldResemble, el)
+		})
+		Convey("a failing handler should lead to a negative acknowledge", func() {
+			fail = true
+			conf, err := SendMO(context.Background(), l.Addr().String(), el)
+			So(err, ShouldBeNil)
+			So(conf.Success(), ShouldBeFalse)
+		})
+	})
+	Convey("given a server which never answers", t, func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer l.Close()
+		go func() {
+			c, err := l.Accept()
+			if err == nil {
+				defer c.Close()
+				time.Sleep(time.Second)
+			}
+		}()
+		el, err := GetElements(bytes.NewBufferString(sample_msg3))
+		So(err, ShouldBeNil)
+
+		Convey("the deadline of the context should be honoured", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			_, err := SendMO(ctx, l.Addr().String(), el)
+			So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+		})
+	})
+}
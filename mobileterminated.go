@@ -2,9 +2,12 @@ package sbd
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"net"
+	"io"
+	"math"
 )
 
 const (
@@ -15,6 +18,10 @@ const (
 	assignMTMSN         = 32
 
 	maxPayload = 1890
+
+	// The allowed range of the MT message priority, 1 is the highest priority.
+	MinPriorityLevel = 1
+	MaxPriorityLevel = 5
 )
 
 // A DirectIPRequest encapsulates the data needed for a directip message.
@@ -24,6 +31,7 @@ type DirectIPRequest struct {
 	clientmsgid      string
 	payload          []byte
 	priorityLevel    *int
+	client           *MTClient
 }
 
 type DirectIPHeader struct {
@@ -31,15 +39,6 @@ type DirectIPHeader struct {
 	IMEI              [15]byte `json:"imei"`
 	DispositionFlags  uint16   `json:"dispositionflags"`
 }
-type mtDirectIPHeader struct {
-	Header
-	DirectIPHeader
-}
-
-type mtPriority struct {
-	Header
-	Level uint16 `json:"level"`
-}
 
 // A Confirmation is returned when a directip call is invoked.
 type Confirmation struct {
@@ -49,102 +48,297 @@ type Confirmation struct {
 	MessageStatus     int16    `json:"messagestatus"`
 }
 
-type confirmationMessage struct {
-	MessageHeader
-	Header
-	Confirmation
+// Status returns the typed message status of the confirmation.
+func (c *Confirmation) Status() MTStatus {
+	return MTStatus(c.MessageStatus)
 }
 
-// DirectOption is the type for configuring the request
-type DirectOption func(rq *DirectIPRequest)
+// MTStatus is the message status of a MT confirmation. Positive values are
+// the position of the message in the MT queue, zero means success without
+// a payload and negative values are errors.
+type MTStatus int16
 
-// NewRequest returns a new request to the given address.
-func NewRequest() *DirectIPRequest {
-	return &DirectIPRequest{}
+const (
+	MTSuccessNoPayload     = MTStatus(0)
+	MTInvalidIMEI          = MTStatus(-1)
+	MTUnknownIMEI          = MTStatus(-2)
+	MTPayloadSizeExceeded  = MTStatus(-3)
+	MTPayloadExpected      = MTStatus(-4)
+	MTQueueFull            = MTStatus(-5)
+	MTResourcesUnavailable = MTStatus(-6)
+	MTProtocolViolation    = MTStatus(-7)
+	MTRingAlertsDisabled   = MTStatus(-8)
+	MTIMEINotAttached      = MTStatus(-9)
+	MTSourceIPRejected     = MTStatus(-10)
+	MTMTMSNOutOfRange      = MTStatus(-11)
+)
+
+// The errors for the negative MT status values, use errors.Is to check the
+// error returned by DirectIPRequest.Do.
+var (
+	ErrInvalidIMEI            = errors.New("invalid IMEI")
+	ErrUnknownIMEI            = errors.New("unknown IMEI")
+	ErrPayloadSizeExceeded    = errors.New("payload size exceeded")
+	ErrPayloadExpected        = errors.New("payload expected but none received")
+	ErrMTQueueFull            = errors.New("MT message queue full")
+	ErrMTResourcesUnavailable = errors.New("MT resources unavailable")
+	ErrMTProtocolViolation    = errors.New("violation of MT directip protocol")
+	ErrRingAlertsDisabled     = errors.New("ring alerts to the IMEI are disabled")
+	ErrIMEINotAttached        = errors.New("IMEI is not attached")
+	ErrSourceIPRejected       = errors.New("source IP address rejected by MT filter")
+	ErrMTMSNOutOfRange        = errors.New("MTMSN value is out of range")
+)
+
+var mtStatusErrors = map[MTStatus]error{
+	MTInvalidIMEI:          ErrInvalidIMEI,
+	MTUnknownIMEI:          ErrUnknownIMEI,
+	MTPayloadSizeExceeded:  ErrPayloadSizeExceeded,
+	MTPayloadExpected:      ErrPayloadExpected,
+	MTQueueFull:            ErrMTQueueFull,
+	MTResourcesUnavailable: ErrMTResourcesUnavailable,
+	MTProtocolViolation:    ErrMTProtocolViolation,
+	MTRingAlertsDisabled:   ErrRingAlertsDisabled,
+	MTIMEINotAttached:      ErrIMEINotAttached,
+	MTSourceIPRejected:     ErrSourceIPRejected,
+	MTMTMSNOutOfRange:      ErrMTMSNOutOfRange,
 }
 
-// With can be used to set some request options.
-func (rq *DirectIPRequest) With(opts ...DirectOption) *DirectIPRequest {
-	for _, o := range opts {
-		o(rq)
+func (s MTStatus) String() string {
+	switch {
+	case s == MTSuccessNoPayload:
+		return "success, no payload"
+	case s > 0:
+		return fmt.Sprintf("queued at position %d", int16(s))
 	}
-	return rq
+	if e, ok := mtStatusErrors[s]; ok {
+		return e.Error()
+	}
+	return fmt.Sprintf("unknown status %d", int16(s))
 }
 
-func (rq *DirectIPRequest) Do(serverAddress string) (*Confirmation, error) {
-	_, _, err := net.SplitHostPort(serverAddress)
+// IsQueued returns true if the message was put in the MT queue.
+func (s MTStatus) IsQueued() bool {
+	return s > 0
+}
+
+// QueuePosition returns the position of the message in the MT queue or
+// zero if the message was not queued.
+func (s MTStatus) QueuePosition() int {
+	if s.IsQueued() {
+		return int(s)
+	}
+	return 0
+}
+
+// Err returns nil for a successful status, otherwise an *MTStatusError.
+func (s MTStatus) Err() error {
+	if s >= 0 {
+		return nil
+	}
+	return &MTStatusError{Status: s}
+}
+
+// An MTStatusError is returned when the gateway rejects a MT message. It
+// unwraps to one of the Err... values, so it can be checked with errors.Is.
+type MTStatusError struct {
+	Status MTStatus
+}
+
+func (e *MTStatusError) Error() string {
+	return fmt.Sprintf("MT message rejected: %s (%d)", e.Status, int16(e.Status))
+}
+
+func (e *MTStatusError) Unwrap() error {
+	return mtStatusErrors[e.Status]
+}
+
+// An MTMessage contains the information elements of a mobile terminated
+// message. A message sent to the gateway has a header and an optional
+// payload and priority, the answer of the gateway has a confirmation.
+type MTMessage struct {
+	MessageHeader MessageHeader   `json:"messageheader"`
+	Header        *DirectIPHeader `json:"header,omitempty"`
+	Payload       []byte          `json:"payload,omitempty"`
+	Priority      *int            `json:"priority,omitempty"`
+	Confirmation  *Confirmation   `json:"confirmation,omitempty"`
+}
+
+// ParseMTMessage reads a complete MT message from the given reader. It
+// returns an error if an information element has an invalid length, is
+// unknown or occurs more than once.
+func ParseMTMessage(in io.Reader) (*MTMessage, error) {
+	mh, err := parseMessageHeader(in)
 	if err != nil {
-		return nil, fmt.Errorf("the server adress must have the form host:port (%q): %v", serverAddress, err)
-	}
-	mth := mtDirectIPHeader{
-		Header: Header{
-			ID:            mtHeaderID,
-			ElementLength: 21,
-		},
-		DirectIPHeader: DirectIPHeader{
-			DispositionFlags: rq.dispositionflags,
-		},
-	}
-	var buf bytes.Buffer
-	cmid := rq.clientmsgid + "\x00\x00\x00\x00"
-	imei := rq.imei + "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"
-	copy(mth.UniqueClientMsgID[:], []byte(cmid)[0:4])
-	copy(mth.IMEI[:], []byte(imei)[0:15])
-	if err := binary.Write(&buf, binary.BigEndian, &mth); err != nil {
-		return nil, fmt.Errorf("cannot write MT Header: %w", err)
-	}
-	if rq.priorityLevel != nil {
-		pr := mtPriority{
-			Header: Header{
-				ID:            mtMessagePriority,
-				ElementLength: uint16(2),
-			},
-			Level: uint16(*rq.priorityLevel),
+		return nil, err
+	}
+	if mh.ProtocolRevision != protocolRevision {
+		return nil, fmt.Errorf("wrong protocol version: %d", mh.ProtocolRevision)
+	}
+	bbuf := make([]byte, mh.MessageLength)
+	if _, err := io.ReadFull(in, bbuf); err != nil {
+		return nil, fmt.Errorf("cannot read bytes from message: %v", err)
+	}
+	msg := &MTMessage{MessageHeader: *mh}
+	seen := make(map[ElementID]bool)
+	for len(bbuf) > 0 {
+		var h Header
+		if err := binary.Read(bytes.NewReader(bbuf), binary.BigEndian, &h); err != nil {
+			return nil, fmt.Errorf("cannot read informationelement header: %v", err)
+		}
+		bbuf = bbuf[binary.Size(h):]
+		if int(h.ElementLength) > len(bbuf) {
+			return nil, fmt.Errorf("informationelement %#x has length %d, but only %d bytes are left", byte(h.ID), h.ElementLength, len(bbuf))
+		}
+		data := bbuf[:h.ElementLength]
+		bbuf = bbuf[h.ElementLength:]
+		if seen[h.ID] {
+			return nil, fmt.Errorf("duplicate informationelement %#x", byte(h.ID))
 		}
-		if err := binary.Write(&buf, binary.BigEndian, &pr); err != nil {
-			return nil, fmt.Errorf("cannot write MT Priority IE: %w", err)
+		seen[h.ID] = true
+
+		switch h.ID {
+		case MTHeaderID:
+			var dih DirectIPHeader
+			if err := decodeElement(h, data, &dih); err != nil {
+				return nil, err
+			}
+			msg.Header = &dih
+		case MTPayloadID:
+			msg.Payload = data
+		case MTPriorityID:
+			var lvl uint16
+			if err := decodeElement(h, data, &lvl); err != nil {
+				return nil, err
+			}
+			prio := int(lvl)
+			if err := checkPriority(prio); err != nil {
+				return nil, err
+			}
+			msg.Priority = &prio
+		case MTConfirmationID:
+			var conf Confirmation
+			if err := decodeElement(h, data, &conf); err != nil {
+				return nil, err
+			}
+			msg.Confirmation = &conf
+		default:
+			return nil, fmt.Errorf("unknown informationelement %#x", byte(h.ID))
 		}
+	}
+	return msg, nil
+}
 
+// Encode writes the message to the given writer. The message length in
+// the MessageHeader is computed, the elements are written in the order
+// header, priority, payload and confirmation.
+func (m *MTMessage) Encode(w io.Writer) error {
+	var body bytes.Buffer
+	if m.Header != nil {
+		if err := writeElement(&body, MTHeaderID, m.Header); err != nil {
+			return err
+		}
 	}
-	if rq.payload != nil {
-		if len(rq.payload) > maxPayload {
-			return nil, fmt.Errorf("the payload is to large (%d)", len(rq.payload))
+	if m.Priority != nil {
+		if err := checkPriority(*m.Priority); err != nil {
+			return err
 		}
-		h := Header{
-			ID:            mtPayloadID,
-			ElementLength: uint16(len(rq.payload)),
+		if err := writeElement(&body, MTPriorityID, uint16(*m.Priority)); err != nil {
+			return err
 		}
-		if err := binary.Write(&buf, binary.BigEndian, &h); err != nil {
-			return nil, fmt.Errorf("cannot write MT Payload IE: %w", err)
+	}
+	if m.Payload != nil {
+		if len(m.Payload) > maxPayload {
+			return fmt.Errorf("the payload is to large (%d)", len(m.Payload))
 		}
-		if _, err := buf.Write(rq.payload); err != nil {
-			return nil, fmt.Errorf("cannot write payload to buffer: %w", err)
+		if err := writeElement(&body, MTPayloadID, m.Payload); err != nil {
+			return err
 		}
 	}
-	data := buf.Bytes()
+	if m.Confirmation != nil {
+		if err := writeElement(&body, MTConfirmationID, m.Confirmation); err != nil {
+			return err
+		}
+	}
+	if body.Len() > math.MaxUint16 {
+		return fmt.Errorf("the message is to large (%d)", body.Len())
+	}
 	h := MessageHeader{
 		ProtocolRevision: protocolRevision,
-		MessageLength:    uint16(len(data)),
+		MessageLength:    uint16(body.Len()),
 	}
-	conn, err := net.Dial("tcp", serverAddress)
-	if err != nil {
-		return nil, fmt.Errorf("cannot dial %q: %v", serverAddress, err)
+	if err := binary.Write(w, binary.BigEndian, &h); err != nil {
+		return fmt.Errorf("cannot write MT Message Header: %v", err)
 	}
-	defer conn.Close()
-	if err := binary.Write(conn, binary.BigEndian, &h); err != nil {
-		return nil, fmt.Errorf("cannot write MT Message Header: %v", err)
+	if _, err := w.Write(body.Bytes()); err != nil {
+		return fmt.Errorf("cannot write message: %v", err)
 	}
-	_, err = conn.Write(data)
-	if err != nil {
-		return nil, fmt.Errorf("cannot write data to connection: %v", err)
+	return nil
+}
+
+func checkPriority(lvl int) error {
+	if lvl < MinPriorityLevel || lvl > MaxPriorityLevel {
+		return fmt.Errorf("the priority level must be in the range %d-%d (%d)", MinPriorityLevel, MaxPriorityLevel, lvl)
+	}
+	return nil
+}
+
+// decodeElement decodes the data of an information element with a fixed size.
+func decodeElement(h Header, data []byte, v interface{}) error {
+	if sz := binary.Size(v); sz != len(data) {
+		return fmt.Errorf("informationelement %#x must have length %d, not %d", byte(h.ID), sz, len(data))
+	}
+	return binary.Read(bytes.NewReader(data), binary.BigEndian, v)
+}
+
+// DirectOption is the type for configuring the request
+type DirectOption func(rq *DirectIPRequest)
+
+// NewRequest returns a new request to the given address.
+func NewRequest() *DirectIPRequest {
+	return &DirectIPRequest{}
+}
+
+// With can be used to set some request options.
+func (rq *DirectIPRequest) With(opts ...DirectOption) *DirectIPRequest {
+	for _, o := range opts {
+		o(rq)
 	}
+	return rq
+}
+
+// Do sends the request to the given server address and returns the
+// confirmation. If the confirmation contains a negative status, the
+// confirmation is returned together with an *MTStatusError.
+func (rq *DirectIPRequest) Do(serverAddress string) (*Confirmation, error) {
+	return rq.DoContext(context.Background(), serverAddress)
+}
 
-	var result confirmationMessage
-	if err := binary.Read(conn, binary.BigEndian, &result); err != nil {
-		return nil, fmt.Errorf("cannot read MT confirmation: %v", err)
+// DoContext is like Do but honours the cancellation and the deadline of
+// the given context while dialing, writing and reading the confirmation.
+// The request is sent with the client configured by WithClient or with
+// the DefaultMTClient.
+func (rq *DirectIPRequest) DoContext(ctx context.Context, serverAddress string) (*Confirmation, error) {
+	c := rq.client
+	if c == nil {
+		c = DefaultMTClient
 	}
+	return c.Do(ctx, serverAddress, rq)
+}
 
-	return &result.Confirmation, nil
+// message returns the request as a MT message.
+func (rq *DirectIPRequest) message() *MTMessage {
+	dih := DirectIPHeader{
+		DispositionFlags: rq.dispositionflags,
+	}
+	cmid := rq.clientmsgid + "\x00\x00\x00\x00"
+	imei := rq.imei + "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"
+	copy(dih.UniqueClientMsgID[:], []byte(cmid)[0:4])
+	copy(dih.IMEI[:], []byte(imei)[0:15])
+	return &MTMessage{
+		Header:   &dih,
+		Payload:  rq.payload,
+		Priority: rq.priorityLevel,
+	}
 }
 
 // FlushMTQueue sets the corresponding disposition flag.
@@ -187,12 +381,21 @@ func Payload(payload []byte) DirectOption {
 }
 
 // PriorityLevel sets the prio level so a priority information element will be added.
+// The level must be in the range of MinPriorityLevel to MaxPriorityLevel,
+// otherwise sending the request fails.
 func PriorityLevel(lvl int) DirectOption {
 	return func(rq *DirectIPRequest) {
 		rq.priorityLevel = &lvl
 	}
 }
 
+// WithClient sets the client which is used to send the request.
+func WithClient(c *MTClient) DirectOption {
+	return func(rq *DirectIPRequest) {
+		rq.client = c
+	}
+}
+
 // ClientMsgID sets the clientmsgi in the header. only the first 4 bytes
 // are used!
 func ClientMsgID(msg string) DirectOption {
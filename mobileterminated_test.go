@@ -1,8 +1,13 @@
 package sbd
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
 	"strings"
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -49,3 +54,174 @@ func TestWithPayload(t *testing.T) {
 	})
 
 }
+
+func TestConfirmationStatus(t *testing.T) {
+	ts, _ := NewDIPServer("127.0.0.1:0")
+	go ts.Start()
+	defer ts.Close()
+	Convey("given a request", t, func() {
+		rq := NewRequest().With(
+			IMEI("123"),
+			Payload([]byte("my dummy payload")),
+		)
+		Convey("a positive status should return the queue position", func() {
+			ts.Handle = func(mg *MessageHeader, dih *DirectIPHeader, payload []byte, priority *int) Confirmation {
+				return Confirmation{MessageStatus: 3}
+			}
+			conf, err := rq.Do(ts.address)
+			So(err, ShouldBeNil)
+			So(conf.Status().IsQueued(), ShouldBeTrue)
+			So(conf.Status().QueuePosition(), ShouldEqual, 3)
+		})
+		Convey("a negative status should return an error", func() {
+			ts.Handle = func(mg *MessageHeader, dih *DirectIPHeader, payload []byte, priority *int) Confirmation {
+				return Confirmation{MessageStatus: int16(MTUnknownIMEI)}
+			}
+			conf, err := rq.Do(ts.address)
+			So(errors.Is(err, ErrUnknownIMEI), ShouldBeTrue)
+			So(conf, ShouldNotBeNil)
+			So(conf.Status().IsQueued(), ShouldBeFalse)
+			var serr *MTStatusError
+			So(errors.As(err, &serr), ShouldBeTrue)
+			So(serr.Status, ShouldEqual, MTUnknownIMEI)
+		})
+	})
+	Convey("the status should have a readable representation", t, func() {
+		So(MTSuccessNoPayload.String(), ShouldEqual, "success, no payload")
+		So(MTStatus(2).String(), ShouldEqual, "queued at position 2")
+		So(MTQueueFull.String(), ShouldEqual, "MT message queue full")
+		So(MTStatus(-42).String(), ShouldEqual, "unknown status -42")
+		So(MTStatus(-42).Err(), ShouldNotBeNil)
+	})
+}
+
+type countingDialer struct {
+	net.Dialer
+	calls int
+}
+
+func (d *countingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.calls++
+	return d.Dialer.DialContext(ctx, network, address)
+}
+
+func TestDoContext(t *testing.T) {
+	Convey("given a gateway which never answers", t, func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer l.Close()
+		go func() {
+			c, err := l.Accept()
+			if err == nil {
+				defer c.Close()
+				time.Sleep(time.Second)
+			}
+		}()
+		rq := NewRequest().With(IMEI("123"))
+
+		Convey("the deadline of the context should be honoured", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			_, err := rq.DoContext(ctx, l.Addr().String())
+			So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+		})
+		Convey("the timeout of the client should be honoured", func() {
+			_, err := rq.With(WithClient(&MTClient{Timeout: 50 * time.Millisecond})).Do(l.Addr().String())
+			So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+		})
+	})
+	Convey("given a client with a custom dialer", t, func() {
+		ts, _ := NewDIPServer("127.0.0.1:0")
+		go ts.Start()
+		defer ts.Close()
+		d := &countingDialer{}
+		rq := NewRequest().With(
+			IMEI("123"),
+			WithClient(&MTClient{Dialer: d}),
+		)
+		Convey("the dialer should be used", func() {
+			_, err := rq.Do(ts.address)
+			So(err, ShouldBeNil)
+			So(d.calls, ShouldEqual, 1)
+		})
+	})
+}
+
+func TestParseMTMessage(t *testing.T) {
+	Convey("given an encoded request with payload and priority", t, func() {
+		rq := NewRequest().With(
+			IMEI("300234063904190"),
+			ClientMsgID("abcd"),
+			Payload([]byte("my dummy payload")),
+			PriorityLevel(2),
+		)
+		var buf bytes.Buffer
+		So(rq.message().Encode(&buf), ShouldBeNil)
+		msg := buf.Bytes()
+
+		Convey("all elements should be parsed", func() {
+			res, err := ParseMTMessage(bytes.NewReader(msg))
+			So(err, ShouldBeNil)
+			So(res.MessageHeader.MessageLength, ShouldEqual, len(msg)-3)
+			So(res.Header, ShouldNotBeNil)
+			So(string(res.Header.IMEI[:]), ShouldEqual, "300234063904190")
+			So(string(res.Header.UniqueClientMsgID[:]), ShouldEqual, "abcd")
+			So(string(res.Payload), ShouldEqual, "my dummy payload")
+			So(*res.Priority, ShouldEqual, 2)
+			So(res.Confirmation, ShouldBeNil)
+		})
+		Convey("an element which is longer than the message should be rejected", func() {
+			msg[len(msg)-len("my dummy payload")-1] = 0xff
+			_, err := ParseMTMessage(bytes.NewReader(msg))
+			So(err, ShouldNotBeNil)
+		})
+		Convey("an unknown element should be rejected", func() {
+			msg[3] = 0x77
+			_, err := ParseMTMessage(bytes.NewReader(msg))
+			So(err, ShouldNotBeNil)
+		})
+		Convey("a truncated message should be rejected", func() {
+			_, err := ParseMTMessage(bytes.NewReader(msg[:len(msg)-3]))
+			So(err, ShouldNotBeNil)
+		})
+	})
+	Convey("given a confirmation message", t, func() {
+		msg := "\x01\x00\x1c\x44\x00\x19abcd300234063904190\x00\x00\x00\x2a\xff\xfe"
+		Convey("the confirmation should be parsed", func() {
+			res, err := ParseMTMessage(bytes.NewBufferString(msg))
+			So(err, ShouldBeNil)
+			So(res.Confirmation, ShouldNotBeNil)
+			So(res.Confirmation.AutoIDReference, ShouldEqual, 42)
+			So(res.Confirmation.Status(), ShouldEqual, MTUnknownIMEI)
+		})
+	})
+}
+
+func TestMTPriority(t *testing.T) {
+	Convey("given a request with an invalid priority", t, func() {
+		rq := NewRequest().With(IMEI("123"), PriorityLevel(6))
+		Convey("the request should not be encoded", func() {
+			var buf bytes.Buffer
+			So(rq.message().Encode(&buf), ShouldNotBeNil)
+		})
+	})
+	Convey("given a message with an invalid priority", t, func() {
+		msg := "\x01\x00\x05\x46\x00\x02\x00\x00"
+		Convey("the message should be rejected", func() {
+			_, err := ParseMTMessage(bytes.NewBufferString(msg))
+			So(err, ShouldNotBeNil)
+		})
+	})
+	Convey("given a confirmation", t, func() {
+		conf := Confirmation{AutoIDReference: 7, MessageStatus: 1}
+		copy(conf.IMEI[:], "300234063904190")
+		Convey("the encoded confirmation should be parsed again", func() {
+			var buf bytes.Buffer
+			So((&MTMessage{Confirmation: &conf}).Encode(&buf), ShouldBeNil)
+			So(buf.Len(), ShouldEqual, 31)
+			res, err := ParseMTMessage(&buf)
+			So(err, ShouldBeNil)
+			So(*res.Confirmation, ShouldResemble, conf)
+		})
+	})
+}
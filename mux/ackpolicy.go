@@ -0,0 +1,100 @@
+package mux
+
+import (
+	"errors"
+	"fmt"
+)
+
+// An AckPolicy decides which targets must receive a message before it is
+// acknowledged. Targets whose outcome does not matter are delivered in the
+// background.
+type AckPolicy string
+
+const (
+	// AckAll acknowledges a message if all matching targets succeed.
+	AckAll = AckPolicy("all")
+	// AckAny acknowledges a message if at least one matching target succeeds.
+	AckAny = AckPolicy("any")
+	// AckPrimaryOnly acknowledges a message if all matching primary
+	// targets succeed.
+	AckPrimaryOnly = AckPolicy("primary-only")
+	// AckQuorum acknowledges a message if a quorum of the matching
+	// targets succeed. If less targets match, all of them must succeed.
+	AckQuorum = AckPolicy("quorum")
+	// AckNone always acknowledges a message.
+	AckNone = AckPolicy("none")
+)
+
+// ParseAckPolicy returns the policy with the given name. An empty name is
+// the default policy AckAll.
+func ParseAckPolicy(s string) (AckPolicy, error) {
+	switch p := AckPolicy(s); p {
+	case "":
+		return AckAll, nil
+	case AckAll, AckAny, AckPrimaryOnly, AckQuorum, AckNone:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown ack policy %q, use all, any, primary-only, quorum or none", s)
+}
+
+// WithAckPolicy sets the policy of the distributer, the default is AckAll.
+func WithAckPolicy(p AckPolicy) Option {
+	return func(f *distributer) {
+		f.ackPolicy = p
+	}
+}
+
+// WithQuorum sets the number of targets which must succeed with the policy
+// AckQuorum, the default is one.
+func WithQuorum(n int) Option {
+	return func(f *distributer) {
+		f.quorum = n
+	}
+}
+
+// ackPolicyFor returns the policy and the quorum of a message for the
+// routed targets. The first target with its own policy decides, otherwise
+// the policy of the distributer is used.
+func (f *distributer) ackPolicyFor(targets []*Target) (AckPolicy, int) {
+	for _, t := range targets {
+		if t.AckPolicy != "" {
+			return t.AckPolicy, t.Quorum
+		}
+	}
+	return f.ackPolicy, f.quorum
+}
+
+// awaits returns true if the outcome of the target is needed for the
+// acknowledge.
+func (p AckPolicy) awaits(t *Target) bool {
+	switch {
+	case t.BestEffort, p == AckNone:
+		return false
+	case p == AckPrimaryOnly:
+		return t.Primary
+	}
+	return true
+}
+
+// result returns the error for the acknowledge from the errors of the
+// awaited targets.
+func (p AckPolicy) result(errs []error, quorum int) error {
+	switch p {
+	case AckAny:
+		quorum = 1
+	case AckQuorum:
+		quorum = min(max(quorum, 1), len(errs))
+	default:
+		return errors.Join(errs...)
+	}
+	succeeded := 0
+	for _, err := range errs {
+		if err == nil {
+			succeeded++
+		}
+	}
+	if succeeded >= quorum {
+		return nil
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,139 @@
+package mux
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrBusy is returned when a message is rejected because the queue of the
+// distributer, the concurrency limit of a target or the background
+// deliveries are exhausted.
+var ErrBusy = errors.New("the distributer is busy")
+
+// An Overflow decides what happens with a message when the queue of the
+// distributer is full or a target has reached its concurrency limit.
+type Overflow string
+
+const (
+	// OverflowHold waits until the message can be handled, so the
+	// connection of the gateway is held open.
+	OverflowHold = Overflow("hold")
+	// OverflowReject rejects the message with ErrBusy, so it is not
+	// acknowledged and the gateway sends it again later.
+	OverflowReject = Overflow("reject")
+)
+
+// ParseOverflow returns the overflow with the given name. An empty name is
+// the default OverflowHold.
+func ParseOverflow(s string) (Overflow, error) {
+	switch o := Overflow(s); o {
+	case "":
+		return OverflowHold, nil
+	case OverflowHold, OverflowReject:
+		return o, nil
+	}
+	return "", fmt.Errorf("unknown overflow %q, use hold or reject", s)
+}
+
+// WithOverflow sets the overflow of the distributer, the default is
+// OverflowHold.
+func WithOverflow(o Overflow) Option {
+	return func(f *distributer) {
+		f.overflow = o
+	}
+}
+
+// WithQueueSize sets the number of messages which wait for a free worker.
+// The default is zero, so a message is only accepted if a worker is free.
+func WithQueueSize(n int) Option {
+	return func(f *distributer) {
+		f.queueSize = n
+	}
+}
+
+// enqueue passes the message to the workers. It returns errClosed when the
+// distributer is closed.
+func (f *distributer) enqueue(msg *sbdMessage) error {
+	select {
+	case <-f.done:
+		return errClosed
+	default:
+	}
+	queueDepth.Inc()
+	if f.overflow != OverflowReject {
+		select {
+		case f.sbdChannel <- msg:
+			return nil
+		case <-f.done:
+			queueDepth.Dec()
+			return errClosed
+		}
+	}
+	select {
+	case f.sbdChannel <- msg:
+		return nil
+	default:
+		queueDepth.Dec()
+		rejectedMessages.WithLabelValues("queue_full").Inc()
+		return ErrBusy
+	}
+}
+
+// WithBackgroundSize sets the number of deliveries which run in the
+// background at the same time. The default is the number of workers.
+func WithBackgroundSize(n int) Option {
+	return func(f *distributer) {
+		f.backgroundSize = n
+	}
+}
+
+// acquireBackground waits for a free slot of the background deliveries.
+func (f *distributer) acquireBackground() error {
+	select {
+	case f.backgroundSlots <- struct{}{}:
+		return nil
+	default:
+	}
+	if f.overflow == OverflowReject {
+		rejectedMessages.WithLabelValues("background_busy").Inc()
+		return ErrBusy
+	}
+	select {
+	case f.backgroundSlots <- struct{}{}:
+		return nil
+	case <-f.done:
+		return errClosed
+	}
+}
+
+func (f *distributer) releaseBackground() {
+	<-f.backgroundSlots
+}
+
+// acquireSlot waits for a free slot of a target with a concurrency limit.
+func (f *distributer) acquireSlot(t *Target) error {
+	if t.slots == nil {
+		return nil
+	}
+	select {
+	case t.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	if f.overflow == OverflowReject {
+		rejectedMessages.WithLabelValues("target_busy").Inc()
+		return ErrBusy
+	}
+	select {
+	case t.slots <- struct{}{}:
+		return nil
+	case <-f.done:
+		return errClosed
+	}
+}
+
+func (f *distributer) releaseSlot(t *Target) {
+	if t.slots != nil {
+		<-t.slots
+	}
+}
@@ -0,0 +1,179 @@
+package mux
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// blockingBackend blocks every call until it is released and records the
+// maximal number of parallel calls.
+type blockingBackend struct {
+	*httptest.Server
+	entered chan struct{}
+	release chan struct{}
+
+	once     sync.Once
+	mu       sync.Mutex
+	running  int
+	parallel int
+}
+
+// unblock releases the running and all future calls.
+func (b *blockingBackend) unblock() {
+	b.once.Do(func() { close(b.release) })
+}
+
+func newBlockingBackend() *blockingBackend {
+	b := &blockingBackend{entered: make(chan struct{}, 100), release: make(chan struct{})}
+	b.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b.mu.Lock()
+		b.running++
+		b.parallel = max(b.parallel, b.running)
+		b.mu.Unlock()
+		b.entered <- struct{}{}
+		<-b.release
+		b.mu.Lock()
+		b.running--
+		b.mu.Unlock()
+	}))
+	return b
+}
+
+func (b *blockingBackend) maxParallel() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.parallel
+}
+
+// handleAsync handles the messages in the background and returns the
+// channel of the results.
+func handleAsync(d Distributer, n int) chan error {
+	res := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() { res <- d.Handle(sampleBucket()) }()
+	}
+	return res
+}
+
+func TestBackpressure(t *testing.T) {
+	Convey("given a slow backend", t, func() {
+		b := newBlockingBackend()
+		defer b.Close()
+		defer b.unblock()
+
+		Convey("the workers should limit the parallel messages", func() {
+			d := New(2, testLogger())
+			defer d.Close()
+			So(d.WithTargets(Targets{{IMEIPattern: ".*", Backend: b.URL}}), ShouldBeNil)
+			res := handleAsync(d, 5)
+			<-b.entered
+			<-b.entered
+			b.unblock()
+			for i := 0; i < 5; i++ {
+				So(<-res, ShouldBeNil)
+			}
+			So(b.maxParallel(), ShouldEqual, 2)
+		})
+		Convey("a full queue should reject a message", func() {
+			d := New(1, testLogger(), WithOverflow(OverflowReject), WithQueueSize(1))
+			defer d.Close()
+			So(d.WithTargets(Targets{{IMEIPattern: ".*", Backend: b.URL}}), ShouldBeNil)
+			res := handleAsync(d, 1)
+			<-b.entered
+			queued := handleAsync(d, 1)
+			waitFor(func() bool { return len(d.(*distributer).sbdChannel) == 1 })
+			So(d.Handle(sampleBucket()), ShouldEqual, ErrBusy)
+			b.unblock()
+			So(<-res, ShouldBeNil)
+			So(<-queued, ShouldBeNil)
+		})
+		Convey("the concurrency limit of a target should be held", func() {
+			d := New(4, testLogger())
+			defer d.Close()
+			So(d.WithTargets(Targets{{IMEIPattern: ".*", Backend: b.URL, MaxConcurrency: 1}}), ShouldBeNil)
+			res := handleAsync(d, 4)
+			<-b.entered
+			b.unblock()
+			for i := 0; i < 4; i++ {
+				So(<-res, ShouldBeNil)
+			}
+			So(b.maxParallel(), ShouldEqual, 1)
+		})
+		Convey("a busy target should reject a message", func() {
+			d := New(4, testLogger(), WithOverflow(OverflowReject), WithQueueSize(4))
+			defer d.Close()
+			So(d.WithTargets(Targets{{IMEIPattern: ".*", Backend: b.URL, MaxConcurrency: 1}}), ShouldBeNil)
+			res := handleAsync(d, 1)
+			<-b.entered
+			So(errors.Is(d.Handle(sampleBucket()), ErrBusy), ShouldBeTrue)
+			b.unblock()
+			So(<-res, ShouldBeNil)
+		})
+		Convey("the background deliveries should be limited", func() {
+			var calls int32
+			wb := countingBackend(&calls, http.StatusOK)
+			defer wb.Close()
+			targets := Targets{
+				{IMEIPattern: ".*", Backend: wb.URL},
+				{IMEIPattern: ".*", Backend: b.URL, BestEffort: true},
+			}
+
+			Convey("and hold the worker if they are busy", func() {
+				d := New(1, testLogger(), WithBackgroundSize(1))
+				defer d.Close()
+				So(d.WithTargets(targets), ShouldBeNil)
+				So(d.Handle(sampleBucket()), ShouldBeNil)
+				<-b.entered
+				res := handleAsync(d, 1)
+				select {
+				case <-res:
+					So("the message should wait for the background delivery", ShouldBeEmpty)
+				case <-time.After(100 * time.Millisecond):
+				}
+				b.unblock()
+				So(<-res, ShouldBeNil)
+				So(b.maxParallel(), ShouldEqual, 1)
+			})
+			Convey("and skip the target if they are busy", func() {
+				d := New(1, testLogger(), WithBackgroundSize(1), WithOverflow(OverflowReject), WithQueueSize(1))
+				defer d.Close()
+				So(d.WithTargets(targets), ShouldBeNil)
+				So(d.Handle(sampleBucket()), ShouldBeNil)
+				<-b.entered
+				So(d.Handle(sampleBucket()), ShouldBeNil)
+				So(atomic.LoadInt32(&calls), ShouldEqual, 2)
+				b.unblock()
+				So(len(b.entered), ShouldEqual, 0)
+			})
+		})
+	})
+	Convey("closing a busy distributer should answer the waiting messages", t, func() {
+		b := newBlockingBackend()
+		defer b.Close()
+		defer b.unblock()
+		d := New(1, testLogger(), WithQueueSize(1))
+		So(d.WithTargets(Targets{{IMEIPattern: ".*", Backend: b.URL, Timeout: 100 * time.Millisecond}}), ShouldBeNil)
+		res := handleAsync(d, 4)
+		<-b.entered
+		waitFor(func() bool { return len(d.(*distributer).sbdChannel) == 1 })
+		d.Close()
+		for i := 0; i < 4; i++ {
+			So(<-res, ShouldNotBeNil)
+		}
+		So(d.Handle(sampleBucket()), ShouldEqual, errClosed)
+	})
+	Convey("an unknown overflow should be rejected", t, func() {
+		_, err := ParseOverflow("drop")
+		So(err, ShouldNotBeNil)
+		o, err := ParseOverflow("")
+		So(err, ShouldBeNil)
+		So(o, ShouldEqual, OverflowHold)
+	})
+}
@@ -0,0 +1,197 @@
+package mux
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTimeout  = 30 * time.Second
+	defaultOpenTime = 30 * time.Second
+)
+
+// ErrCircuitOpen is returned when a target is not called because its
+// circuit breaker is open.
+var ErrCircuitOpen = errors.New("the circuit breaker of the target is open")
+
+// The states of a circuit breaker.
+const (
+	CircuitClosed   = "closed"
+	CircuitHalfOpen = "half-open"
+	CircuitOpen     = "open"
+)
+
+// A BreakerPolicy configures the circuit breaker of a target. When the
+// target fails Failures times in a row, it is not called for OpenTime.
+// Then the next message is sent as a probe; if it succeeds, the circuit
+// is closed again. The zero value disables the breaker.
+type BreakerPolicy struct {
+	Failures int           `yaml:"failures,omitempty" json:"failures,omitempty"`
+	OpenTime time.Duration `yaml:"opentime,omitempty" json:"opentime,omitempty"`
+}
+
+func (p *BreakerPolicy) validate() error {
+	if p.Failures < 0 || p.OpenTime < 0 {
+		return fmt.Errorf("the breaker settings must not be negative")
+	}
+	return nil
+}
+
+// TargetHealth is the health of a target.
+type TargetHealth struct {
+	Target              string    `json:"target"`
+	Backend             string    `json:"backend"`
+	State               string    `json:"state"`
+	ConsecutiveFailures int       `json:"consecutivefailures"`
+	LastError           string    `json:"lasterror,omitempty"`
+	LastFailure         time.Time `json:"lastfailure,omitzero"`
+	LastSuccess         time.Time `json:"lastsuccess,omitzero"`
+}
+
+// A breaker tracks the health of a target and implements its circuit
+// breaker. A nil breaker allows every call.
+type breaker struct {
+	policy BreakerPolicy
+	label  string
+
+	mu        sync.Mutex
+	health    TargetHealth
+	openUntil time.Time
+	probing   bool
+}
+
+func newBreaker(t *Target) *breaker {
+	b := &breaker{policy: t.Breaker, label: t.label()}
+	if b.policy.OpenTime == 0 {
+		b.policy.OpenTime = defaultOpenTime
+	}
+	b.health = TargetHealth{Target: t.label(), Backend: t.Backend, State: CircuitClosed}
+	return b
+}
+
+// allow returns nil if the target can be called. After the open time one
+// call is allowed as a probe.
+func (b *breaker) allow(now time.Time) error {
+	if b == nil || b.policy.Failures == 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.health.State {
+	case CircuitOpen:
+		if now.Before(b.openUntil) {
+			return ErrCircuitOpen
+		}
+		b.setState(CircuitHalfOpen)
+	case CircuitHalfOpen:
+		if b.probing {
+			return ErrCircuitOpen
+		}
+	}
+	b.probing = b.health.State == CircuitHalfOpen
+	return nil
+}
+
+// record stores the result of a call. A call which is cancelled because
+// the distributer is closed is ignored.
+func (b *breaker) record(now time.Time, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	if !isFailure(err) {
+		b.health.ConsecutiveFailures = 0
+		b.health.LastSuccess = now
+		b.setState(CircuitClosed)
+		return
+	}
+	b.health.ConsecutiveFailures++
+	b.health.LastFailure = now
+	b.health.LastError = err.Error()
+	if b.policy.Failures == 0 {
+		return
+	}
+	if b.health.State == CircuitHalfOpen || b.health.ConsecutiveFailures >= b.policy.Failures {
+		b.openUntil = now.Add(b.policy.OpenTime)
+		b.setState(CircuitOpen)
+	}
+}
+
+func (b *breaker) setState(s string) {
+	b.health.State = s
+	b.publish()
+}
+
+// publish sets the metric of the state.
+func (b *breaker) publish() {
+	for _, st := range []string{CircuitClosed, CircuitHalfOpen, CircuitOpen} {
+		v := 0.0
+		if st == b.health.State {
+			v = 1
+		}
+		targetState.WithLabelValues(b.label, st).Set(v)
+	}
+}
+
+func (b *breaker) state() TargetHealth {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.health
+}
+
+// publishStates replaces the metrics of the target states with the states
+// of the given targets.
+func publishStates(targets Targets) {
+	targetState.Reset()
+	for _, t := range targets {
+		t.breaker.mu.Lock()
+		t.breaker.publish()
+		t.breaker.mu.Unlock()
+	}
+}
+
+// isFailure returns true if the error shows that the target is not
+// healthy. A target which answers with a client error is reachable, so
+// it is healthy, and a permanent error is the fault of the message.
+func isFailure(err error) bool {
+	if err == nil || isPermanent(err) {
+		return false
+	}
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code >= http.StatusInternalServerError || se.code == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// timeout returns the timeout of a single call to the target.
+func (t *Target) timeout() time.Duration {
+	if t.Timeout > 0 {
+		return t.Timeout
+	}
+	return defaultTimeout
+}
+
+// Health returns the health of the current targets. Targets with the same
+// sink configuration share their health.
+func (f *distributer) Health() []TargetHealth {
+	table := f.acquire()
+	defer f.release(table)
+	if table == nil {
+		return nil
+	}
+	var res []TargetHealth
+	for _, t := range table.targets {
+		res = append(res, t.breaker.state())
+	}
+	return res
+}
@@ -0,0 +1,108 @@
+package mux
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBreaker(t *testing.T) {
+	Convey("given a backend which does not answer in time", t, func() {
+		release := make(chan struct{})
+		b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+		defer b.Close()
+		defer close(release)
+		d := New(1, testLogger())
+		defer d.Close()
+
+		Convey("the call should fail after the timeout of the target", func() {
+			So(d.WithTargets(Targets{{IMEIPattern: ".*", Backend: b.URL, Timeout: 50 * time.Millisecond}}), ShouldBeNil)
+			start := time.Now()
+			So(d.Handle(sampleBucket()), ShouldNotBeNil)
+			So(time.Since(start), ShouldBeLessThan, time.Second)
+			h := d.Health()
+			So(h, ShouldHaveLength, 1)
+			So(h[0].ConsecutiveFailures, ShouldEqual, 1)
+			So(h[0].LastError, ShouldNotBeEmpty)
+		})
+	})
+	Convey("given a backend which fails and recovers", t, func() {
+		var calls int32
+		b := countingBackend(&calls, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusOK)
+		defer b.Close()
+		d := New(1, testLogger())
+		defer d.Close()
+		So(d.WithTargets(Targets{{ID: "a", IMEIPattern: ".*", Backend: b.URL, Breaker: BreakerPolicy{Failures: 2, OpenTime: 100 * time.Millisecond}}}), ShouldBeNil)
+		So(d.Handle(sampleBucket()), ShouldNotBeNil)
+		So(d.Handle(sampleBucket()), ShouldNotBeNil)
+
+		Convey("the circuit should be open after the failures", func() {
+			So(errors.Is(d.Handle(sampleBucket()), ErrCircuitOpen), ShouldBeTrue)
+			So(atomic.LoadInt32(&calls), ShouldEqual, 2)
+			So(d.Health()[0].State, ShouldEqual, CircuitOpen)
+		})
+		Convey("a probe should close the circuit after the open time", func() {
+			time.Sleep(150 * time.Millisecond)
+			So(d.Handle(sampleBucket()), ShouldBeNil)
+			So(atomic.LoadInt32(&calls), ShouldEqual, 3)
+			h := d.Health()[0]
+			So(h.State, ShouldEqual, CircuitClosed)
+			So(h.ConsecutiveFailures, ShouldEqual, 0)
+		})
+		Convey("the circuit should survive a reconfiguration", func() {
+			So(d.WithTargets(d.Targets()), ShouldBeNil)
+			So(d.Health()[0].State, ShouldEqual, CircuitOpen)
+		})
+	})
+	Convey("a probe which is rejected by a busy target should not block the circuit", t, func() {
+		var calls int32
+		b := countingBackend(&calls, http.StatusServiceUnavailable, http.StatusOK)
+		defer b.Close()
+		d := New(1, testLogger(), WithOverflow(OverflowReject), WithQueueSize(1))
+		defer d.Close()
+		So(d.WithTargets(Targets{{IMEIPattern: ".*", Backend: b.URL, MaxConcurrency: 1, Breaker: BreakerPolicy{Failures: 1, OpenTime: 50 * time.Millisecond}}}), ShouldBeNil)
+		So(d.Handle(sampleBucket()), ShouldNotBeNil)
+		So(d.Health()[0].State, ShouldEqual, CircuitOpen)
+		time.Sleep(100 * time.Millisecond)
+		slots := d.(*distributer).table.Load().targets[0].slots
+		slots <- struct{}{}
+		So(errors.Is(d.Handle(sampleBucket()), ErrBusy), ShouldBeTrue)
+		<-slots
+		So(d.Handle(sampleBucket()), ShouldBeNil)
+		So(d.Health()[0].State, ShouldEqual, CircuitClosed)
+	})
+	Convey("a message for an open circuit should not be stored as dead letter", t, func() {
+		var calls int32
+		b := countingBackend(&calls, http.StatusServiceUnavailable)
+		defer b.Close()
+		dl, err := OpenDeadLetters(t.TempDir())
+		So(err, ShouldBeNil)
+		d := New(1, testLogger(), WithDeadLetters(dl))
+		defer d.Close()
+		So(d.WithTargets(Targets{{IMEIPattern: ".*", Backend: b.URL, Breaker: BreakerPolicy{Failures: 1}}}), ShouldBeNil)
+		So(d.Handle(sampleBucket()), ShouldBeNil)
+		So(errors.Is(d.Handle(sampleBucket()), ErrCircuitOpen), ShouldBeTrue)
+		letters, err := dl.List()
+		So(err, ShouldBeNil)
+		So(letters, ShouldHaveLength, 1)
+	})
+	Convey("a backend which rejects the message should not open the circuit", t, func() {
+		var calls int32
+		b := countingBackend(&calls, http.StatusBadRequest)
+		defer b.Close()
+		d := New(1, testLogger())
+		defer d.Close()
+		So(d.WithTargets(Targets{{IMEIPattern: ".*", Backend: b.URL, Breaker: BreakerPolicy{Failures: 1}}}), ShouldBeNil)
+		So(d.Handle(sampleBucket()), ShouldNotBeNil)
+		So(d.Handle(sampleBucket()), ShouldNotBeNil)
+		So(atomic.LoadInt32(&calls), ShouldEqual, 2)
+		So(d.Health()[0].State, ShouldEqual, CircuitClosed)
+	})
+}
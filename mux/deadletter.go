@@ -0,0 +1,156 @@
+package mux
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/protegear/sbd"
+)
+
+// A DeadLetter contains a message which could not be delivered to a
+// target after all attempts of its retry policy. The secret and the
+// header values of the target are not stored, Signed tells if the target
+// has a secret and HeaderNames are the names of its header.
+type DeadLetter struct {
+	ID          string                 `json:"-"`
+	Time        time.Time              `json:"time"`
+	Target      Target                 `json:"target"`
+	Signed      bool                   `json:"signed,omitempty"`
+	HeaderNames []string               `json:"headernames,omitempty"`
+	Attempts    int                    `json:"attempts"`
+	Error       string                 `json:"error"`
+	Data        *sbd.InformationBucket `json:"data"`
+}
+
+// DeadLetters stores the dead letters as files in a directory, so they
+// can be inspected and delivered again.
+type DeadLetters struct {
+	dir   string
+	names fileNames
+}
+
+// OpenDeadLetters opens the dead letter storage in the given directory.
+func OpenDeadLetters(dir string) (*DeadLetters, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("cannot create dead letter directory %q: %v", dir, err)
+	}
+	return &DeadLetters{dir: dir}, nil
+}
+
+// Add stores the dead letter without the secret and the header values of
+// its target and sets its ID.
+func (d *DeadLetters) Add(dl *DeadLetter) error {
+	dl.Signed = dl.Signed || dl.Target.Secret != ""
+	if len(dl.Target.Header) > 0 {
+		dl.HeaderNames = slices.Sorted(maps.Keys(dl.Target.Header))
+	}
+	dl.Target.Secret = ""
+	dl.Target.Header = nil
+	js, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	name := d.names.next(queueSuffix)
+	if err := writeSynced(d.dir, name, js); err != nil {
+		return fmt.Errorf("cannot write dead letter: %v", err)
+	}
+	dl.ID = strings.TrimSuffix(name, queueSuffix)
+	return nil
+}
+
+// List returns all dead letters, the oldest first.
+func (d *DeadLetters) List() ([]*DeadLetter, error) {
+	files, err := os.ReadDir(d.dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read dead letter directory %q: %v", d.dir, err)
+	}
+	var ids []string
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), queueSuffix) {
+			ids = append(ids, strings.TrimSuffix(f.Name(), queueSuffix))
+		}
+	}
+	sort.Strings(ids)
+	var res []*DeadLetter
+	for _, id := range ids {
+		dl, err := d.Load(id)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, dl)
+	}
+	return res, nil
+}
+
+// Load returns the dead letter with the given ID.
+func (d *DeadLetters) Load(id string) (*DeadLetter, error) {
+	js, err := os.ReadFile(filepath.Join(d.dir, filepath.Base(id)+queueSuffix))
+	if err != nil {
+		return nil, err
+	}
+	var dl DeadLetter
+	if err := json.Unmarshal(js, &dl); err != nil {
+		return nil, fmt.Errorf("cannot parse dead letter %q: %v", id, err)
+	}
+	dl.ID = id
+	return &dl, nil
+}
+
+// Remove deletes the dead letter with the given ID.
+func (d *DeadLetters) Remove(id string) error {
+	return os.Remove(filepath.Join(d.dir, filepath.Base(id)+queueSuffix))
+}
+
+// Redrive delivers the dead letter to its target again with the retry
+// policy of the target. The secret and the header of the target are taken
+// from the target with the same ID, or the same backend if it has no ID,
+// in the given current targets. If the delivery succeeds, the dead letter
+// is removed.
+func (d *DeadLetters) Redrive(dl *DeadLetter, current Targets, log *slog.Logger) error {
+	t := dl.Target
+	if dl.Signed || len(dl.HeaderNames) > 0 {
+		c, ok := current.find(&t)
+		if !ok {
+			return fmt.Errorf("no target %q configured for the secret and the header", t.label())
+		}
+		if dl.Signed && c.Secret == "" {
+			return fmt.Errorf("no secret configured for the signed target %q", t.label())
+		}
+		t.Secret = c.Secret
+		t.Header = maps.Clone(c.Header)
+	}
+	js, err := json.Marshal(dl.Data)
+	if err != nil {
+		return err
+	}
+	f := newDistributer(log)
+	defer f.Close()
+	table, err := f.newTable(Targets{t})
+	if err != nil {
+		return err
+	}
+	defer f.release(table)
+	if _, err := f.deliver(&table.targets[0], js, dl.Data); err != nil {
+		return err
+	}
+	return d.Remove(dl.ID)
+}
+
+// find returns the target with the same ID or, if the target has no ID,
+// the same backend.
+func (ts Targets) find(t *Target) (*Target, bool) {
+	for i := range ts {
+		if ts[i].label() == t.label() {
+			return &ts[i], true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,207 @@
+package mux
+
+import (
+	"bufio"
+	"container/list"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/protegear/sbd"
+)
+
+var errInFlight = errors.New("the same message is handled right now")
+
+// messageKey identifies a MO message, iridium uses the same values when
+// it sends a message again.
+type messageKey struct {
+	IMEI         string
+	CDRReference uint32
+	MOMSN        uint16
+}
+
+func keyOf(data *sbd.InformationBucket) messageKey {
+	return messageKey{
+		IMEI:         data.Header.GetIMEI(),
+		CDRReference: data.Header.CDRReference,
+		MOMSN:        data.Header.MOMSN,
+	}
+}
+
+type dedupDistributer struct {
+	Distributer
+	*slog.Logger
+	size int
+
+	mu       sync.Mutex
+	seen     map[messageKey]*list.Element
+	order    *list.List
+	inflight map[messageKey]bool
+	file     *os.File
+	written  int
+}
+
+// NewDeduplicated returns a Distributer which remembers the last size
+// messages which were handled successfully. If such a message is sent
+// again, it is acknowledged without calling the next Distributer. If a
+// file is given, the remembered messages are stored there so they survive
+// a restart.
+func NewDeduplicated(next Distributer, size int, file string, log *slog.Logger) (Distributer, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("the size of the deduplication cache must be positive: %d", size)
+	}
+	d := &dedupDistributer{
+		Distributer: next,
+		Logger:      log,
+		size:        size,
+		seen:        make(map[messageKey]*list.Element),
+		order:       list.New(),
+		inflight:    make(map[messageKey]bool),
+	}
+	if file != "" {
+		if err := d.load(file); err != nil {
+			return nil, err
+		}
+		if err := d.compact(file); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+func (d *dedupDistributer) Handle(data *sbd.InformationBucket) error {
+	if data.Header == nil {
+		return d.Distributer.Handle(data)
+	}
+	k := keyOf(data)
+	d.mu.Lock()
+	if _, ok := d.seen[k]; ok {
+		d.mu.Unlock()
+		duplicateMessages.Inc()
+		d.Info("drop duplicate message", "imei", k.IMEI, "cdrreference", k.CDRReference, "momsn", k.MOMSN)
+		return nil
+	}
+	if d.inflight[k] {
+		// we do not know if the running delivery succeeds, so iridium
+		// has to send it again
+		d.mu.Unlock()
+		return errInFlight
+	}
+	d.inflight[k] = true
+	d.mu.Unlock()
+
+	err := d.Distributer.Handle(data)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.inflight, k)
+	if err == nil {
+		d.remember(k)
+		d.persist(k)
+	}
+	return err
+}
+
+// remember adds the key to the cache and evicts the oldest key if the
+// cache is full. The lock must be held.
+func (d *dedupDistributer) remember(k messageKey) {
+	if e, ok := d.seen[k]; ok {
+		d.order.MoveToBack(e)
+		return
+	}
+	d.seen[k] = d.order.PushBack(k)
+	if d.order.Len() > d.size {
+		e := d.order.Front()
+		d.order.Remove(e)
+		delete(d.seen, e.Value.(messageKey))
+	}
+}
+
+// persist appends the key to the file and compacts the file when it
+// contains too many old keys. The lock must be held.
+func (d *dedupDistributer) persist(k messageKey) {
+	if d.file == nil {
+		return
+	}
+	if _, err := fmt.Fprintf(d.file, "%q %d %d\n", k.IMEI, k.CDRReference, k.MOMSN); err != nil {
+		d.Error("cannot store message key", "error", err)
+		return
+	}
+	d.written++
+	if d.written > 2*d.size {
+		if err := d.compact(d.file.Name()); err != nil {
+			d.Error("cannot compact deduplication file", "error", err)
+		}
+	}
+}
+
+func (d *dedupDistributer) load(file string) error {
+	f, err := os.Open(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot open deduplication file: %v", err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var k messageKey
+		if _, err := fmt.Sscanf(sc.Text(), "%q %d %d", &k.IMEI, &k.CDRReference, &k.MOMSN); err != nil {
+			d.Warn("ignore invalid line in deduplication file", "line", sc.Text(), "error", err)
+			continue
+		}
+		d.remember(k)
+	}
+	return sc.Err()
+}
+
+// compact rewrites the file with the keys of the cache and opens it for
+// appending.
+func (d *dedupDistributer) compact(file string) error {
+	tmp := file + tempSuffix
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for e := d.order.Front(); e != nil; e = e.Next() {
+		k := e.Value.(messageKey)
+		fmt.Fprintf(w, "%q %d %d\n", k.IMEI, k.CDRReference, k.MOMSN)
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	af, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if d.file != nil {
+		d.file.Close()
+	}
+	d.file = af
+	d.written = 0
+	return nil
+}
+
+func (d *dedupDistributer) Close() {
+	d.Distributer.Close()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.file != nil {
+		d.file.Close()
+	}
+}
@@ -0,0 +1,50 @@
+package mux
+
+import (
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDeduplication(t *testing.T) {
+	Convey("given a deduplicating distributer", t, func() {
+		file := filepath.Join(t.TempDir(), "dedup")
+		rec := &recordingDistributer{}
+		d, err := NewDeduplicated(rec, 2, file, testLogger())
+		So(err, ShouldBeNil)
+		// the restart replaces d, so the current one is closed
+		defer func() { d.Close() }()
+
+		Convey("a message which is sent twice should be delivered once", func() {
+			So(d.Handle(sampleBucket()), ShouldBeNil)
+			So(d.Handle(sampleBucket()), ShouldBeNil)
+			So(rec.count(), ShouldEqual, 1)
+		})
+		Convey("a message with another MOMSN should be delivered", func() {
+			So(d.Handle(sampleBucket()), ShouldBeNil)
+			b := sampleBucket()
+			b.Header.MOMSN++
+			So(d.Handle(b), ShouldBeNil)
+			So(rec.count(), ShouldEqual, 2)
+		})
+		Convey("the oldest message should be forgotten when the cache is full", func() {
+			So(d.Handle(sampleBucket()), ShouldBeNil)
+			for i := 1; i <= 2; i++ {
+				b := sampleBucket()
+				b.Header.MOMSN += uint16(i)
+				So(d.Handle(b), ShouldBeNil)
+			}
+			So(d.Handle(sampleBucket()), ShouldBeNil)
+			So(rec.count(), ShouldEqual, 4)
+		})
+		Convey("the messages should be remembered after a restart", func() {
+			So(d.Handle(sampleBucket()), ShouldBeNil)
+			d.Close()
+			d, err = NewDeduplicated(rec, 2, file, testLogger())
+			So(err, ShouldBeNil)
+			So(d.Handle(sampleBucket()), ShouldBeNil)
+			So(rec.count(), ShouldEqual, 1)
+		})
+	})
+}
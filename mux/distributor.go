@@ -10,162 +10,424 @@
 package mux
 
 import (
-	"bytes"
-	"crypto/tls"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log/slog"
-	"net/http"
 	"regexp"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
 
 	"github.com/protegear/sbd"
 )
 
 // A Target stores the configuration of a backend service where the SBD data should be pushed.
 type Target struct {
-	ID          string            `yaml:"id,omitempty"`
-	IMEIPattern string            `yaml:"imeipattern"`
-	Backend     string            `yaml:"backend"`
-	SkipTLS     bool              `yaml:"skiptls,omitempty"`
-	Header      map[string]string `yaml:"header"`
+	ID          string            `yaml:"id,omitempty" json:"id,omitempty"`
+	IMEIPattern string            `yaml:"imeipattern" json:"imeipattern"`
+	Backend     string            `yaml:"backend" json:"backend"`
+	SkipTLS     bool              `yaml:"skiptls,omitempty" json:"skiptls,omitempty"`
+	Header      map[string]string `yaml:"header" json:"header,omitempty"`
+	Retry       RetryPolicy       `yaml:"retry,omitempty" json:"retry,omitempty"`
+	// TLS configures the certificates and the TLS version of a webhook.
+	TLS *TLSConfig `yaml:"tls,omitempty" json:"tls,omitempty"`
+	// Secret signs the webhook calls, see VerifyWebhook. It is not part
+	// of the JSON representation, so it is not logged.
+	Secret string `yaml:"secret,omitempty" json:"-"`
+	// Primary targets must succeed if the ack policy is primary-only.
+	Primary bool `yaml:"primary,omitempty" json:"primary,omitempty"`
+	// BestEffort targets are delivered in the background and never
+	// influence the acknowledge.
+	BestEffort bool `yaml:"besteffort,omitempty" json:"besteffort,omitempty"`
+	// AckPolicy overrides the ack policy of the distributer for the
+	// messages which are routed to this target first.
+	AckPolicy AckPolicy `yaml:"ackpolicy,omitempty" json:"ackpolicy,omitempty"`
+	// Quorum is the number of targets which must succeed with the
+	// AckPolicy AckQuorum.
+	Quorum int `yaml:"quorum,omitempty" json:"quorum,omitempty"`
+	// Targets with a higher priority are evaluated first.
+	Priority int `yaml:"priority,omitempty" json:"priority,omitempty"`
+	// If a Final target matches, the targets with a lower priority are
+	// not evaluated.
+	Final bool `yaml:"final,omitempty" json:"final,omitempty"`
+	// Match is an optional rule for the content of the message which must
+	// match additionally to the IMEIPattern.
+	Match *Rule `yaml:"match,omitempty" json:"match,omitempty"`
+	// Type selects the sink which delivers the message, the default is
+	// an HTTP webhook.
+	Type string `yaml:"type,omitempty" json:"type,omitempty"`
+	// Topic is the subject of a NATS or the topic of a MQTT sink. It is
+	// a template which can use the IMEI, e.g. "sbd/{{.IMEI}}".
+	Topic string `yaml:"topic,omitempty" json:"topic,omitempty"`
+	// Command is the program and its arguments of an exec sink.
+	Command []string `yaml:"command,omitempty" json:"command,omitempty"`
+	// MaxConcurrency limits the number of parallel deliveries to the
+	// target, zero means no limit.
+	MaxConcurrency int `yaml:"maxconcurrency,omitempty" json:"maxconcurrency,omitempty"`
+	// Timeout limits a single call of the target, the default is 30s.
+	Timeout time.Duration `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	Breaker BreakerPolicy `yaml:"breaker,omitempty" json:"breaker,omitempty"`
+	// Template renders the body instead of the JSON encoded message. It
+	// is a text/template with the fields IMEI and Data.
+	Template string `yaml:"template,omitempty" json:"template,omitempty"`
+	// ContentType is the content type of a webhook, the default is
+	// application/json.
+	ContentType string `yaml:"contenttype,omitempty" json:"contenttype,omitempty"`
 	imeipattern *regexp.Regexp
-	client      *http.Client
+	matcher     matcher
+	sink        Sink
+	slots       chan struct{}
+	breaker     *breaker
+	body        *template.Template
 }
 
 // Targets is a list of Target's
 type Targets []Target
 
+// LogValue hides the secrets of the targets in the logs.
+func (ts Targets) LogValue() slog.Value {
+	res := make([]Target, len(ts))
+	for i, t := range ts {
+		if t.Secret != "" {
+			t.Secret = "***"
+		}
+		res[i] = t
+	}
+	return slog.AnyValue(res)
+}
+
 // A Distributer can handle the SBD data and dispatches them to the targets. When
 // the targets are reconfigured, the can be set vith WithTargets.
 type Distributer interface {
 	WithTargets(targets Targets) error
 	Targets() Targets
+	Health() []TargetHealth
 	Handle(data *sbd.InformationBucket) error
 	Close()
 }
 
+var errClosed = errors.New("the distributer is closed")
+
+// A permanentError is a failure which a retry cannot fix, e.g. a message
+// without a MO header or a body which cannot be rendered.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+func permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// isPermanent returns true if the error is permanent. A joined error is
+// permanent if all its errors are permanent.
+func isPermanent(err error) bool {
+	if j, ok := err.(interface{ Unwrap() []error }); ok {
+		errs := j.Unwrap()
+		for _, e := range errs {
+			if !isPermanent(e) {
+				return false
+			}
+		}
+		return len(errs) > 0
+	}
+	var pe *permanentError
+	return errors.As(err, &pe)
+}
+
 type distributer struct {
 	*slog.Logger
-	targets       []Target
-	sbdChannel    chan *sbdMessage
-	configChannel chan Targets
+	sbdChannel  chan *sbdMessage
+	deadLetters *DeadLetters
+	ackPolicy   AckPolicy
+	quorum      int
+	routing     Routing
+	overflow    Overflow
+	queueSize   int
+	// backgroundSlots limits the deliveries which run in the background.
+	backgroundSize  int
+	backgroundSlots chan struct{}
+	background      sync.WaitGroup
+	done            chan struct{}
+	// stopped is closed when all workers have stopped, so the messages
+	// which are still queued are answered with errClosed.
+	workers sync.WaitGroup
+	stopped chan struct{}
+	// ctx is passed to the sinks and cancelled when the distributer
+	// is closed and the running deliveries are finished.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// table is the current routing table, it is only replaced while
+	// the configLock is held.
+	table      atomic.Pointer[routingTable]
+	configLock sync.Mutex
+	sinkLock   sync.Mutex
+	sinks      map[string]*sharedSink
+}
+
+// An Option configures the distributer.
+type Option func(*distributer)
+
+// WithDeadLetters stores messages which cannot be delivered to a target
+// after all retries in the given dead letter storage. A stored message
+// counts as handled, so it is acknowledged.
+func WithDeadLetters(dl *DeadLetters) Option {
+	return func(f *distributer) {
+		f.deadLetters = dl
+	}
 }
 
 type sbdMessage struct {
 	data          sbd.InformationBucket
 	returnedError chan error
+	// delivery is set for queued messages, the targets which received
+	// the message in a previous attempt are skipped.
+	delivery *delivery
 }
 
 // New creates a new Distributor with the given number of workers
-func New(numworkers int, log *slog.Logger) Distributer {
-	sc := make(chan *sbdMessage)
-	cc := make(chan Targets)
-	s := &distributer{
-		sbdChannel:    sc,
-		configChannel: cc,
-		Logger:        log,
+func New(numworkers int, log *slog.Logger, opts ...Option) Distributer {
+	s := newDistributer(log, opts...)
+	if s.backgroundSize <= 0 {
+		s.backgroundSize = numworkers
 	}
+	s.backgroundSlots = make(chan struct{}, s.backgroundSize)
+	s.workers.Add(numworkers)
 	for i := 0; i < numworkers; i++ {
 		go s.run(i)
 	}
 	return s
 }
 
-func (f *distributer) Targets() Targets {
-	return f.targets
+// newDistributer creates a distributer without workers, so it can only
+// deliver to the targets of its tables.
+func newDistributer(log *slog.Logger, opts ...Option) *distributer {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &distributer{
+		Logger:    log,
+		ackPolicy: AckAll,
+		routing:   RoutingFanout,
+		overflow:  OverflowHold,
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+		ctx:       ctx,
+		cancel:    cancel,
+		sinks:     make(map[string]*sharedSink),
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	s.sbdChannel = make(chan *sbdMessage, s.queueSize)
+	empty := &routingTable{}
+	empty.refs.Store(1)
+	s.table.Store(empty)
+	return s
 }
 
-func (f *distributer) WithTargets(targets Targets) error {
-	var ar Targets
-	for _, t := range targets {
-		p, err := regexp.Compile(t.IMEIPattern)
+// prepare validates the target and compiles the pattern and the rule.
+func (t *Target) prepare() error {
+	p, err := regexp.Compile(t.IMEIPattern)
+	if err != nil {
+		return fmt.Errorf("cannot compile patter: %q: %v", t.IMEIPattern, err)
+	}
+	if err := t.Retry.validate(); err != nil {
+		return fmt.Errorf("invalid retry policy for %q: %v", t.Backend, err)
+	}
+	if t.Timeout < 0 {
+		return fmt.Errorf("timeout of %q must not be negative", t.Backend)
+	}
+	if err := t.Breaker.validate(); err != nil {
+		return fmt.Errorf("invalid breaker for %q: %v", t.Backend, err)
+	}
+	if t.MaxConcurrency < 0 {
+		return fmt.Errorf("maxconcurrency of %q must not be negative", t.Backend)
+	}
+	if t.AckPolicy != "" {
+		if _, err := ParseAckPolicy(string(t.AckPolicy)); err != nil {
+			return fmt.Errorf("invalid target %q: %v", t.Backend, err)
+		}
+	}
+	if t.Quorum < 0 {
+		return fmt.Errorf("quorum of %q must not be negative", t.Backend)
+	}
+	if t.Template != "" {
+		tpl, err := bodyTemplate(t.Template)
 		if err != nil {
-			return fmt.Errorf("cannot compile patter: %q: %v", t.IMEIPattern, err)
+			return fmt.Errorf("invalid target %q: %v", t.Backend, err)
 		}
-		t.imeipattern = p
-		tr := &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: t.SkipTLS,
-			},
+		t.body = tpl
+	}
+	t.imeipattern = p
+	t.matcher = matchAll
+	if t.Match != nil {
+		m, err := t.Match.compile()
+		if err != nil {
+			return fmt.Errorf("invalid match rule for %q: %v", t.Backend, err)
 		}
-		t.client = &http.Client{Transport: tr}
-
-		ar = append(ar, t)
+		t.matcher = m
 	}
-	f.configChannel <- ar
 	return nil
 }
 
+// accepts returns true if the message should be delivered to the target.
+func (t *Target) accepts(imei string, data *sbd.InformationBucket) bool {
+	return t.imeipattern.MatchString(imei) && t.matcher(data)
+}
+
 func (f *distributer) Handle(data *sbd.InformationBucket) error {
-	return f.distribute(data)
+	return f.distribute(data, nil)
+}
+
+// handleTracked handles the message but skips the targets which are
+// already in the delivery and adds the targets which succeed.
+func (f *distributer) handleTracked(data *sbd.InformationBucket, d *delivery) error {
+	return f.distribute(data, d)
 }
 
-func (f *distributer) distribute(data *sbd.InformationBucket) error {
-	msg := &sbdMessage{data: *data, returnedError: make(chan error)}
-	f.sbdChannel <- msg
-	rerr := <-msg.returnedError
-	close(msg.returnedError)
-	return rerr
+func (f *distributer) distribute(data *sbd.InformationBucket, d *delivery) error {
+	// the result is buffered, so a worker never waits for a caller
+	// which has given up because the distributer was closed
+	msg := &sbdMessage{data: *data, returnedError: make(chan error, 1), delivery: d}
+	if err := f.enqueue(msg); err != nil {
+		return err
+	}
+	select {
+	case rerr := <-msg.returnedError:
+		return rerr
+	case <-f.stopped:
+		select {
+		case rerr := <-msg.returnedError:
+			return rerr
+		default:
+			return errClosed
+		}
+	}
 }
 
 func (f *distributer) Close() {
 	f.Info("close distributor")
-	close(f.configChannel)
-	close(f.sbdChannel)
+	close(f.done)
+	// the workers start the background deliveries, so they have to be
+	// stopped before the background deliveries are awaited
+	f.workers.Wait()
+	close(f.stopped)
+	f.background.Wait()
+	f.cancel()
+	f.configLock.Lock()
+	defer f.configLock.Unlock()
+	f.release(f.table.Swap(nil))
 }
 
 func (f *distributer) run(worker int) {
 	f.Info("start distributor service", "worker", worker)
+	defer f.workers.Done()
 	for {
 		select {
-		case cfg, more := <-f.configChannel:
-			if !more {
-				return
-			}
-			f.Info("set config", "config", cfg, "worker", worker)
-			f.targets = cfg
 		case msg := <-f.sbdChannel:
-			go f.handle(msg)
+			queueDepth.Dec()
+			f.handle(msg)
+		case <-f.done:
+			return
 		}
 	}
 }
 
 func (f *distributer) handle(m *sbdMessage) {
+	if m.data.Header == nil {
+		m.returnedError <- permanent(errors.New("the message contains no MO header"))
+		return
+	}
 	js, err := json.Marshal(m.data)
 	if err != nil {
 		m.returnedError <- err
 		return
 	}
+	table := f.acquire()
+	if table == nil {
+		m.returnedError <- errClosed
+		return
+	}
+	defer f.release(table)
 	imei := m.data.Header.GetIMEI()
-	for _, t := range f.targets {
-		if t.imeipattern.MatchString(imei) {
-			rq, err := http.NewRequest(http.MethodPost, t.Backend, bytes.NewBuffer(js))
-			if err != nil {
-				f.Error("cannot create request", "error", err, "target", t.Backend)
-				m.returnedError <- err
-				return
-			}
-			rq.Header.Add("Content-Type", "application/json")
-			for k, v := range t.Header {
-				rq.Header.Add(k, v)
-			}
-			rsp, err := t.client.Do(rq)
-			if err != nil {
-				f.Error("cannot call webhook", "target", t.Backend, "error", err)
-				m.returnedError <- err
-				return
+	var errs []error
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	targets := f.route(table.targets, imei, &m.data)
+	policy, quorum := f.ackPolicyFor(targets)
+	for _, t := range targets {
+		if m.delivery.has(t) {
+			// a target which received the message in an earlier attempt
+			// counts as success
+			if policy.awaits(t) {
+				mu.Lock()
+				errs = append(errs, nil)
+				mu.Unlock()
 			}
-			defer rsp.Body.Close()
-			content, _ := io.ReadAll(rsp.Body)
-			if rsp.StatusCode/100 == 2 {
-				f.Info("data transmitted", "target", t.Backend, "status", rsp.Status, "content", string(content))
-			} else {
-				f.Error("data not transmitted", "target", t.Backend, "status", rsp.Status, "content", string(content))
-				m.returnedError <- err
-				return
+			continue
+		}
+		if !policy.awaits(t) {
+			if err := f.acquireBackground(); err != nil {
+				f.Warn("skip best effort target", "target", t.Backend, "error", err)
+				continue
 			}
+			// the background delivery keeps the table alive
+			table.refs.Add(1)
+			f.background.Add(1)
+			go func() {
+				defer f.background.Done()
+				defer f.releaseBackground()
+				defer f.release(table)
+				if err := f.deliverTarget(t, js, &m.data); err != nil {
+					f.Error("cannot deliver to best effort target", "target", t.Backend, "error", err)
+				} else {
+					m.delivery.add(t)
+				}
+			}()
+			continue
 		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := f.deliverTarget(t, js, &m.data)
+			if err == nil {
+				m.delivery.add(t)
+			}
+			mu.Lock()
+			errs = append(errs, err)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	m.returnedError <- policy.result(errs, quorum)
+}
+
+// deliverTarget delivers the message to the target. If the delivery fails
+// and a dead letter storage is configured, the message is stored there. A
+// message which is rejected because the target is busy or its circuit is
+// open or the distributer is closed is not stored, so it is not
+// acknowledged and sent again later.
+func (f *distributer) deliverTarget(t *Target, js []byte, data *sbd.InformationBucket) error {
+	attempts, err := f.deliver(t, js, data)
+	if err == nil || f.deadLetters == nil || errors.Is(err, ErrBusy) || errors.Is(err, ErrCircuitOpen) || errors.Is(err, errClosed) {
+		return err
 	}
-	m.returnedError <- nil
+	dl := &DeadLetter{
+		Time:     time.Now(),
+		Target:   *t,
+		Attempts: attempts,
+		Error:    err.Error(),
+		Data:     data,
+	}
+	if derr := f.deadLetters.Add(dl); derr != nil {
+		f.Error("cannot store dead letter", "target", t.Backend, "error", derr)
+		return err
+	}
+	f.Warn("stored undeliverable message as dead letter", "target", t.Backend, "deadletter", dl.ID, "error", err)
+	return nil
 }
@@ -0,0 +1,250 @@
+package mux
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func testLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError + 1}))
+}
+
+// countingBackend answers with the given status codes in turn, the last
+// one is repeated.
+func countingBackend(calls *int32, status ...int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt32(calls, 1))
+		w.WriteHeader(status[min(n, len(status))-1])
+	}))
+}
+
+func TestRetryPolicy(t *testing.T) {
+	Convey("given a retry policy", t, func() {
+		p := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+		Convey("the backoff should grow exponentially up to the maximum", func() {
+			So(p.backoff(1), ShouldEqual, time.Second)
+			So(p.backoff(2), ShouldEqual, 2*time.Second)
+			So(p.backoff(3), ShouldEqual, 4*time.Second)
+			So(p.backoff(4), ShouldEqual, 5*time.Second)
+		})
+		Convey("the jitter should stay in its range", func() {
+			p.Jitter = 0.5
+			for i := 0; i < 20; i++ {
+				So(p.backoff(1), ShouldBeBetweenOrEqual, 500*time.Millisecond, 1500*time.Millisecond)
+			}
+		})
+		Convey("the default status codes should be retried", func() {
+			So(p.retryable(http.StatusServiceUnavailable), ShouldBeTrue)
+			So(p.retryable(http.StatusBadRequest), ShouldBeFalse)
+			p.RetryStatus = []int{http.StatusBadRequest}
+			So(p.retryable(http.StatusBadRequest), ShouldBeTrue)
+		})
+	})
+}
+
+func TestDeliveryRetries(t *testing.T) {
+	retry := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+
+	Convey("given a failing and a working backend", t, func() {
+		var failing, working int32
+		fb := countingBackend(&failing, http.StatusServiceUnavailable)
+		defer fb.Close()
+		wb := countingBackend(&working, http.StatusOK)
+		defer wb.Close()
+		targets := Targets{
+			{IMEIPattern: ".*", Backend: fb.URL, Retry: retry},
+			{IMEIPattern: ".*", Backend: wb.URL, Retry: retry},
+		}
+
+		Convey("without dead letters the message should not be acknowledged", func() {
+			d := New(1, testLogger())
+			defer d.Close()
+			So(d.WithTargets(targets), ShouldBeNil)
+			So(d.Handle(sampleBucket()), ShouldNotBeNil)
+			So(atomic.LoadInt32(&failing), ShouldEqual, 3)
+			So(atomic.LoadInt32(&working), ShouldEqual, 1)
+		})
+		Convey("with dead letters the message should be stored and acknowledged", func() {
+			dl, err := OpenDeadLetters(t.TempDir())
+			So(err, ShouldBeNil)
+			d := New(1, testLogger(), WithDeadLetters(dl))
+			defer d.Close()
+			So(d.WithTargets(targets), ShouldBeNil)
+			So(d.Handle(sampleBucket()), ShouldBeNil)
+			So(atomic.LoadInt32(&working), ShouldEqual, 1)
+
+			letters, err := dl.List()
+			So(err, ShouldBeNil)
+			So(letters, ShouldHaveLength, 1)
+			So(letters[0].Target.Backend, ShouldEqual, fb.URL)
+			So(letters[0].Attempts, ShouldEqual, 3)
+			So(letters[0].Data.Header.GetIMEI(), ShouldEqual, "300234063904190")
+
+			Convey("and a redrive should remove it when the backend works again", func() {
+				letters[0].Target.Backend = wb.URL
+				So(dl.Redrive(letters[0], nil, testLogger()), ShouldBeNil)
+				So(atomic.LoadInt32(&working), ShouldEqual, 2)
+				letters, err := dl.List()
+				So(err, ShouldBeNil)
+				So(letters, ShouldBeEmpty)
+			})
+		})
+	})
+	Convey("a retry which is interrupted by close should not be stored as dead letter", t, func() {
+		var calls int32
+		b := countingBackend(&calls, http.StatusServiceUnavailable)
+		defer b.Close()
+		dl, err := OpenDeadLetters(t.TempDir())
+		So(err, ShouldBeNil)
+		d := New(1, testLogger(), WithDeadLetters(dl))
+		So(d.WithTargets(Targets{{IMEIPattern: ".*", Backend: b.URL, Retry: RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Minute}}}), ShouldBeNil)
+		res := handleAsync(d, 1)
+		So(waitFor(func() bool { return atomic.LoadInt32(&calls) == 1 }), ShouldBeTrue)
+		d.Close()
+		So(errors.Is(<-res, errClosed), ShouldBeTrue)
+		letters, err := dl.List()
+		So(err, ShouldBeNil)
+		So(letters, ShouldBeEmpty)
+	})
+	Convey("given a backend which recovers", t, func() {
+		var calls int32
+		b := countingBackend(&calls, http.StatusBadGateway, http.StatusOK)
+		defer b.Close()
+		d := New(1, testLogger())
+		defer d.Close()
+		So(d.WithTargets(Targets{{IMEIPattern: ".*", Backend: b.URL, Retry: retry}}), ShouldBeNil)
+		Convey("the message should be delivered with a retry", func() {
+			So(d.Handle(sampleBucket()), ShouldBeNil)
+			So(atomic.LoadInt32(&calls), ShouldEqual, 2)
+		})
+	})
+}
+
+func TestAckPolicy(t *testing.T) {
+	Convey("given a failing and a working backend", t, func() {
+		var failing, working int32
+		fb := countingBackend(&failing, http.StatusBadRequest)
+		defer fb.Close()
+		wb := countingBackend(&working, http.StatusOK)
+		defer wb.Close()
+		targets := Targets{
+			{IMEIPattern: ".*", Backend: fb.URL},
+			{IMEIPattern: ".*", Backend: wb.URL, Primary: true},
+		}
+		handle := func(p AckPolicy, targets Targets) error {
+			d := New(1, testLogger(), WithAckPolicy(p))
+			defer d.Close()
+			So(d.WithTargets(targets), ShouldBeNil)
+			return d.Handle(sampleBucket())
+		}
+
+		Convey("all should not acknowledge", func() {
+			So(handle(AckAll, targets), ShouldNotBeNil)
+		})
+		Convey("any should acknowledge", func() {
+			So(handle(AckAny, targets), ShouldBeNil)
+		})
+		Convey("primary-only should acknowledge", func() {
+			So(handle(AckPrimaryOnly, targets), ShouldBeNil)
+		})
+		Convey("none should acknowledge", func() {
+			So(handle(AckNone, targets), ShouldBeNil)
+		})
+		Convey("all should acknowledge if the failing target is best effort", func() {
+			targets[0].BestEffort = true
+			So(handle(AckAll, targets), ShouldBeNil)
+		})
+		Convey("a quorum of one should acknowledge", func() {
+			So(handle(AckQuorum, targets), ShouldBeNil)
+		})
+		Convey("a quorum of two should not acknowledge", func() {
+			targets[0].AckPolicy, targets[0].Quorum = AckQuorum, 2
+			So(handle(AckNone, targets), ShouldNotBeNil)
+		})
+		Convey("the policy of the first routed target with a policy should decide", func() {
+			targets[0].Priority = 1
+			targets[0].AckPolicy = AckAny
+			So(handle(AckAll, targets), ShouldBeNil)
+			targets[1].Priority = 2
+			targets[1].AckPolicy = AckAll
+			So(handle(AckNone, targets), ShouldNotBeNil)
+		})
+		Convey("an unknown policy of a target should be rejected", func() {
+			d := New(1, testLogger())
+			defer d.Close()
+			targets[0].AckPolicy = "some"
+			So(d.WithTargets(targets), ShouldNotBeNil)
+		})
+		Convey("every target should be called", func() {
+			handle(AckNone, targets)
+			So(atomic.LoadInt32(&failing), ShouldEqual, 1)
+			So(atomic.LoadInt32(&working), ShouldEqual, 1)
+		})
+	})
+	Convey("an unknown policy should be rejected", t, func() {
+		_, err := ParseAckPolicy("some")
+		So(err, ShouldNotBeNil)
+		p, err := ParseAckPolicy("")
+		So(err, ShouldBeNil)
+		So(p, ShouldEqual, AckAll)
+	})
+}
+
+func TestRouting(t *testing.T) {
+	Convey("given a specific and a catch-all target", t, func() {
+		var specific, catchall int32
+		sb := countingBackend(&specific, http.StatusOK)
+		defer sb.Close()
+		cb := countingBackend(&catchall, http.StatusOK)
+		defer cb.Close()
+		targets := Targets{
+			{ID: "a", IMEIPattern: ".*", Backend: cb.URL},
+			{ID: "b", IMEIPattern: "300234.*", Backend: sb.URL, Priority: 10},
+		}
+		handle := func(r Routing, targets Targets) {
+			d := New(1, testLogger(), WithRouting(r))
+			defer d.Close()
+			So(d.WithTargets(targets), ShouldBeNil)
+			So(d.Handle(sampleBucket()), ShouldBeNil)
+		}
+
+		Convey("fanout should deliver to both", func() {
+			handle(RoutingFanout, targets)
+			So(atomic.LoadInt32(&specific), ShouldEqual, 1)
+			So(atomic.LoadInt32(&catchall), ShouldEqual, 1)
+		})
+		Convey("fanout should stop at a final target", func() {
+			targets[1].Final = true
+			handle(RoutingFanout, targets)
+			So(atomic.LoadInt32(&specific), ShouldEqual, 1)
+			So(atomic.LoadInt32(&catchall), ShouldEqual, 0)
+		})
+		Convey("first-match should deliver to the target with the highest priority", func() {
+			handle(RoutingFirstMatch, targets)
+			So(atomic.LoadInt32(&specific), ShouldEqual, 1)
+			So(atomic.LoadInt32(&catchall), ShouldEqual, 0)
+		})
+	})
+	Convey("targets with the same priority should be sorted deterministically", t, func() {
+		targets := Targets{
+			{ID: "c", Priority: 1},
+			{ID: "b"},
+			{ID: "a"},
+			{ID: "d", Priority: 2},
+		}
+		sortTargets(targets)
+		var ids []string
+		for _, t := range targets {
+			ids = append(ids, t.ID)
+		}
+		So(ids, ShouldResemble, []string{"d", "c", "a", "b"})
+	})
+}
@@ -0,0 +1,71 @@
+package mux
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	webhookDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "directip_webhook_duration_seconds",
+		Help:    "The duration of the webhook calls per target.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"target"})
+	webhookResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "directip_webhook_responses_total",
+		Help: "The number of webhook calls per target and status class (2xx, 4xx, 5xx, error).",
+	}, []string{"target", "class"})
+	configuredTargets = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "directip_targets",
+		Help: "The number of configured targets.",
+	})
+	targetState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "directip_target_state",
+		Help: "The state of the circuit breaker per target, the current state (closed, half-open, open) is 1.",
+	}, []string{"target", "state"})
+	queueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "directip_queue_depth",
+		Help: "The number of messages which wait for a free worker.",
+	})
+	rejectedMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "directip_rejected_messages_total",
+		Help: "The number of messages which were rejected by reason (queue_full, target_busy, background_busy).",
+	}, []string{"reason"})
+	duplicateMessages = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "directip_duplicate_messages_total",
+		Help: "The number of messages which were acknowledged without delivery because they were already delivered.",
+	})
+)
+
+// Collectors returns the metrics of the distributer, so they can be
+// registered with a prometheus registry.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		webhookDuration,
+		webhookResponses,
+		configuredTargets,
+		targetState,
+		queueDepth,
+		rejectedMessages,
+		duplicateMessages,
+	}
+}
+
+// label returns the name of the target which is used in the metrics.
+func (t *Target) label() string {
+	if t.ID != "" {
+		return t.ID
+	}
+	return t.Backend
+}
+
+func observeWebhook(t *Target, start time.Time, status int, err error) {
+	webhookDuration.WithLabelValues(t.label()).Observe(time.Since(start).Seconds())
+	class := "error"
+	if err == nil {
+		class = fmt.Sprintf("%dxx", status/100)
+	}
+	webhookResponses.WithLabelValues(t.label(), class).Inc()
+}
@@ -0,0 +1,424 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/protegear/sbd"
+)
+
+const (
+	queueSuffix = ".json"
+	rawSuffix   = ".sbd"
+	tempSuffix  = ".tmp"
+	// failedDir is the subdirectory of the queue for the entries which
+	// cannot be loaded or delivered.
+	failedDir = "failed"
+
+	initialRetryDelay = 1 * time.Second
+	maxRetryDelay     = 5 * time.Minute
+)
+
+var errNoTargets = errors.New("no targets configured")
+
+// A queue stores every message in its own file in a directory. The files
+// are named by the time they are received, so the order is preserved
+// after a restart.
+type queue struct {
+	dir   string
+	names fileNames
+}
+
+// openQueue opens the queue in the given directory and returns the names
+// of the entries which are not delivered yet.
+func openQueue(dir string) (*queue, []string, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, nil, fmt.Errorf("cannot create queue directory %q: %v", dir, err)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot read queue directory %q: %v", dir, err)
+	}
+	var pending []string
+	for _, f := range files {
+		switch {
+		case strings.HasSuffix(f.Name(), tempSuffix):
+			// the message was never acknowledged, so iridium will send it again
+			os.Remove(filepath.Join(dir, f.Name()))
+		case strings.HasSuffix(f.Name(), queueSuffix), strings.HasSuffix(f.Name(), rawSuffix):
+			pending = append(pending, f.Name())
+		}
+	}
+	sort.Strings(pending)
+	return &queue{dir: dir}, pending, nil
+}
+
+// append writes the message to the disk and syncs it before it returns.
+// A received message is stored as it was received, so it can be relayed
+// unchanged, other messages are stored as JSON.
+func (q *queue) append(data *sbd.InformationBucket) (string, error) {
+	if raw := data.Raw(); raw != nil {
+		name := q.names.next(rawSuffix)
+		if err := writeSynced(q.dir, name, raw); err != nil {
+			return "", fmt.Errorf("cannot write queue entry: %v", err)
+		}
+		return name, nil
+	}
+	js, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	name := q.names.next(queueSuffix)
+	if err := writeSynced(q.dir, name, js); err != nil {
+		return "", fmt.Errorf("cannot write queue entry: %v", err)
+	}
+	return name, nil
+}
+
+// fileNames creates unique file names from the current time, so the
+// names are ordered by their creation.
+type fileNames struct {
+	mu   sync.Mutex
+	last int64
+}
+
+func (n *fileNames) next(suffix string) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := time.Now().UnixNano()
+	if now <= n.last {
+		now = n.last + 1
+	}
+	n.last = now
+	return fmt.Sprintf("%020d%s", now, suffix)
+}
+
+// writeSynced writes the data to a temporary file and renames it, so the
+// file is complete when it exists. The file and the directory are synced.
+func writeSynced(dir, name string, data []byte) error {
+	tmp := filepath.Join(dir, name+tempSuffix)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(dir, name))
+	}
+	if err == nil {
+		err = syncDir(dir)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (q *queue) load(name string) (*sbd.InformationBucket, error) {
+	js, err := os.ReadFile(filepath.Join(q.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(name, rawSuffix) {
+		data, err := sbd.GetElements(bytes.NewReader(js))
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse queue entry %q: %v", name, err)
+		}
+		return data, nil
+	}
+	var data sbd.InformationBucket
+	if err := json.Unmarshal(js, &data); err != nil {
+		return nil, fmt.Errorf("cannot parse queue entry %q: %v", name, err)
+	}
+	return &data, nil
+}
+
+func (q *queue) remove(name string) error {
+	return os.Remove(filepath.Join(q.dir, name))
+}
+
+// quarantine moves the entry to the failed directory, so it is not
+// delivered again but can be inspected and moved back to the queue.
+func (q *queue) quarantine(name string) error {
+	dir := filepath.Join(q.dir, failedDir)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	if err := os.Rename(filepath.Join(q.dir, name), filepath.Join(dir, name)); err != nil {
+		return err
+	}
+	return syncDir(q.dir)
+}
+
+// A delivery is the set of targets which have received a queued message,
+// so a retry is only delivered to the other targets. A nil delivery is
+// empty and stays empty.
+type delivery struct {
+	mu      sync.Mutex
+	targets map[string]bool
+}
+
+func (d *delivery) has(t *Target) bool {
+	if d == nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.targets[t.sinkKey()]
+}
+
+func (d *delivery) add(t *Target) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.targets == nil {
+		d.targets = make(map[string]bool)
+	}
+	d.targets[t.sinkKey()] = true
+}
+
+// A trackingHandler can skip the targets which already received a
+// message.
+type trackingHandler interface {
+	handleTracked(data *sbd.InformationBucket, d *delivery) error
+}
+
+type queuedDistributer struct {
+	Distributer
+	*slog.Logger
+	queue *queue
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	pending  []string
+	retries  map[string]*time.Timer
+	attempts map[string]int
+	// deliveries are kept for the retries of the entries, they are lost
+	// on a restart, so a replayed entry is delivered to all targets.
+	deliveries map[string]*delivery
+	closed     bool
+	workers    sync.WaitGroup
+
+	maxAttempts int
+}
+
+// A QueueOption configures the queued distributer.
+type QueueOption func(*queuedDistributer)
+
+// WithMaxAttempts limits the deliveries of a queued message. A message
+// which still fails is moved to the failed directory of the queue. The
+// default zero retries until the delivery succeeds.
+func WithMaxAttempts(n int) QueueOption {
+	return func(f *queuedDistributer) {
+		f.maxAttempts = n
+	}
+}
+
+// NewQueued returns a Distributer which stores every message in a queue in
+// the given directory before it is acknowledged. The messages are delivered
+// in the background by the given number of workers with the next
+// Distributer. Failed deliveries are retried with an exponential backoff
+// until they succeed or the attempts of WithMaxAttempts are exhausted, a
+// retry skips the targets which already received the message. Undelivered
+// messages are delivered again to all targets when the queue is opened
+// after a restart. Entries which cannot be loaded are moved to the failed
+// directory of the queue.
+func NewQueued(next Distributer, dir string, numworkers int, log *slog.Logger, opts ...QueueOption) (Distributer, error) {
+	q, pending, err := openQueue(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &queuedDistributer{
+		Distributer: next,
+		Logger:      log,
+		queue:       q,
+		pending:     pending,
+		retries:     make(map[string]*time.Timer),
+		attempts:    make(map[string]int),
+		deliveries:  make(map[string]*delivery),
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	s.cond = sync.NewCond(&s.mu)
+	if len(pending) > 0 {
+		log.Info("replay queued messages", "count", len(pending), "queue", dir)
+	}
+	for i := 0; i < numworkers; i++ {
+		s.workers.Add(1)
+		go s.run(i)
+	}
+	return s, nil
+}
+
+func (f *queuedDistributer) Handle(data *sbd.InformationBucket) error {
+	name, err := f.queue.append(data)
+	if err != nil {
+		f.Error("cannot queue message", "error", err)
+		return err
+	}
+	f.push(name)
+	return nil
+}
+
+func (f *queuedDistributer) push(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.retries, name)
+	if f.closed {
+		return
+	}
+	f.pending = append(f.pending, name)
+	f.cond.Signal()
+}
+
+func (f *queuedDistributer) next() (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.pending) == 0 && !f.closed {
+		f.cond.Wait()
+	}
+	if f.closed {
+		return "", false
+	}
+	name := f.pending[0]
+	f.pending = f.pending[1:]
+	return name, true
+}
+
+func (f *queuedDistributer) run(worker int) {
+	defer f.workers.Done()
+	f.Info("start queue worker", "worker", worker)
+	for {
+		name, ok := f.next()
+		if !ok {
+			return
+		}
+		data, err := f.queue.load(name)
+		if err != nil {
+			f.Error("cannot load queued message, move it to the failed entries", "entry", name, "error", err)
+			f.fail(name)
+			continue
+		}
+		if len(f.Distributer.Targets()) == 0 {
+			// we would lose the message, so wait until we have a config
+			f.retry(name, errNoTargets)
+			continue
+		}
+		if err := f.handle(name, data); err != nil {
+			f.retry(name, err)
+			continue
+		}
+		f.done(name)
+	}
+}
+
+// handle passes the message to the next distributer. If it can track the
+// targets, a retry is not delivered again to the targets which succeeded.
+func (f *queuedDistributer) handle(name string, data *sbd.InformationBucket) error {
+	th, ok := f.Distributer.(trackingHandler)
+	if !ok {
+		return f.Distributer.Handle(data)
+	}
+	f.mu.Lock()
+	d := f.deliveries[name]
+	if d == nil {
+		d = &delivery{}
+		f.deliveries[name] = d
+	}
+	f.mu.Unlock()
+	return th.handleTracked(data, d)
+}
+
+// retry schedules the next delivery of the entry. When the attempts are
+// exhausted or the error is permanent, the entry is moved to the failed
+// entries. A message is not
+// given up while there is no config, and it stays in the queue when the
+// distributer is closed.
+func (f *queuedDistributer) retry(name string, err error) {
+	f.mu.Lock()
+	if f.closed || errors.Is(err, errClosed) {
+		f.mu.Unlock()
+		f.Warn("queued message stays in the queue", "entry", name, "error", err)
+		return
+	}
+	f.attempts[name]++
+	attempts := f.attempts[name]
+	if isPermanent(err) || (f.maxAttempts > 0 && attempts >= f.maxAttempts && !errors.Is(err, errNoTargets)) {
+		f.mu.Unlock()
+		f.Error("cannot deliver queued message, move it to the failed entries", "entry", name, "error", err, "attempts", attempts)
+		f.fail(name)
+		return
+	}
+	defer f.mu.Unlock()
+	delay := retryDelay(attempts)
+	f.Error("cannot deliver queued message", "entry", name, "error", err, "retry", delay)
+	f.retries[name] = time.AfterFunc(delay, func() { f.push(name) })
+}
+
+// fail moves the entry to the failed directory.
+func (f *queuedDistributer) fail(name string) {
+	f.mu.Lock()
+	delete(f.attempts, name)
+	delete(f.deliveries, name)
+	f.mu.Unlock()
+	if err := f.queue.quarantine(name); err != nil {
+		f.Error("cannot move failed message", "entry", name, "error", err)
+	}
+}
+
+func (f *queuedDistributer) done(name string) {
+	f.mu.Lock()
+	delete(f.attempts, name)
+	delete(f.deliveries, name)
+	f.mu.Unlock()
+	if err := f.queue.remove(name); err != nil {
+		f.Error("cannot remove delivered message from queue", "entry", name, "error", err)
+	}
+}
+
+func (f *queuedDistributer) Close() {
+	f.mu.Lock()
+	f.closed = true
+	for _, t := range f.retries {
+		t.Stop()
+	}
+	f.cond.Broadcast()
+	f.mu.Unlock()
+	f.workers.Wait()
+	f.Distributer.Close()
+}
+
+func retryDelay(attempt int) time.Duration {
+	d := initialRetryDelay
+	for i := 1; i < attempt && d < maxRetryDelay; i++ {
+		d *= 2
+	}
+	return min(d, maxRetryDelay)
+}
@@ -0,0 +1,234 @@
+package mux
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/protegear/sbd"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const sampleMsg = "\x01\x008\x01\x00\x1cp\xec\ai300234063904190\x00\x00K\x00\x00U\x9e\xba,\x02\x00\x16test message0123456789"
+
+type recordingDistributer struct {
+	mu       sync.Mutex
+	targets  Targets
+	received []*sbd.InformationBucket
+	err      error
+}
+
+func (r *recordingDistributer) WithTargets(targets Targets) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.targets = targets
+	return nil
+}
+
+func (r *recordingDistributer) Targets() Targets {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.targets
+}
+
+func (r *recordingDistributer) Health() []TargetHealth {
+	return nil
+}
+
+func (r *recordingDistributer) Handle(data *sbd.InformationBucket) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.received = append(r.received, data)
+	return r.err
+}
+
+func (r *recordingDistributer) Close() {}
+
+func (r *recordingDistributer) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.received)
+}
+
+func sampleBucket() *sbd.InformationBucket {
+	b, err := sbd.GetElements(bytes.NewBufferString(sampleMsg))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func waitFor(cond func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func queueEntries(dir string) int {
+	files, _ := os.ReadDir(dir)
+	n := 0
+	for _, f := range files {
+		if !f.IsDir() {
+			n++
+		}
+	}
+	return n
+}
+
+func TestQueuedDistributer(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError}))
+
+	Convey("given a queued distributer", t, func() {
+		dir := t.TempDir()
+		rec := &recordingDistributer{targets: Targets{{ID: "test"}}}
+		q, err := NewQueued(rec, dir, 2, log)
+		So(err, ShouldBeNil)
+		defer q.Close()
+
+		Convey("a handled message should be delivered and removed from the queue", func() {
+			data := sampleBucket()
+			So(q.Handle(data), ShouldBeNil)
+			So(waitFor(func() bool { return rec.count() == 1 }), ShouldBeTrue)
+			So(waitFor(func() bool { return queueEntries(dir) == 0 }), ShouldBeTrue)
+			So(rec.received[0].Header.GetIMEI(), ShouldEqual, data.Header.GetIMEI())
+			So(rec.received[0].Payload, ShouldResemble, data.Payload)
+		})
+	})
+
+	Convey("given a queued distributer with a failing and a working target", t, func() {
+		var failing, working int32
+		fb := countingBackend(&failing, http.StatusServiceUnavailable, http.StatusOK)
+		defer fb.Close()
+		wb := countingBackend(&working, http.StatusOK)
+		defer wb.Close()
+		d := New(1, log)
+		once := RetryPolicy{MaxAttempts: 1}
+		So(d.WithTargets(Targets{
+			{IMEIPattern: ".*", Backend: fb.URL, Retry: once},
+			{IMEIPattern: ".*", Backend: wb.URL, Retry: once},
+		}), ShouldBeNil)
+		dir := t.TempDir()
+		q, err := NewQueued(d, dir, 1, log)
+		So(err, ShouldBeNil)
+		defer q.Close()
+
+		Convey("a retry should only be delivered to the failed target", func() {
+			So(q.Handle(sampleBucket()), ShouldBeNil)
+			So(waitFor(func() bool { return atomic.LoadInt32(&failing) == 1 }), ShouldBeTrue)
+			time.Sleep(initialRetryDelay)
+			So(waitFor(func() bool { return queueEntries(dir) == 0 }), ShouldBeTrue)
+			So(atomic.LoadInt32(&failing), ShouldEqual, 2)
+			So(atomic.LoadInt32(&working), ShouldEqual, 1)
+		})
+	})
+
+	Convey("given a queued distributer with a failing next distributer", t, func() {
+		dir := t.TempDir()
+		rec := &recordingDistributer{targets: Targets{{ID: "test"}}, err: errors.New("failed")}
+
+		Convey("the message should be delivered after a restart", func() {
+			q, err := NewQueued(rec, dir, 1, log)
+			So(err, ShouldBeNil)
+			So(q.Handle(sampleBucket()), ShouldBeNil)
+			So(waitFor(func() bool { return rec.count() == 1 }), ShouldBeTrue)
+			q.Close()
+			So(queueEntries(dir), ShouldEqual, 1)
+
+			next := &recordingDistributer{targets: Targets{{ID: "test"}}}
+			q, err = NewQueued(next, dir, 1, log)
+			So(err, ShouldBeNil)
+			defer q.Close()
+			So(waitFor(func() bool { return next.count() == 1 }), ShouldBeTrue)
+			So(waitFor(func() bool { return queueEntries(dir) == 0 }), ShouldBeTrue)
+		})
+		Convey("the message should be moved to the failed entries after the attempts", func() {
+			q, err := NewQueued(rec, dir, 1, log, WithMaxAttempts(1))
+			So(err, ShouldBeNil)
+			defer q.Close()
+			So(q.Handle(sampleBucket()), ShouldBeNil)
+			So(waitFor(func() bool { return queueEntries(filepath.Join(dir, failedDir)) == 1 }), ShouldBeTrue)
+			So(queueEntries(dir), ShouldEqual, 0)
+			So(rec.count(), ShouldEqual, 1)
+		})
+	})
+
+	Convey("given a queued distributer which delivers to a webhook", t, func() {
+		var calls int32
+		b := countingBackend(&calls, http.StatusOK)
+		defer b.Close()
+		d := New(1, log)
+		dir := t.TempDir()
+		q, err := NewQueued(d, dir, 1, log)
+		So(err, ShouldBeNil)
+		defer q.Close()
+		failed := func() bool { return queueEntries(filepath.Join(dir, failedDir)) == 1 }
+
+		Convey("a message without a header should be moved to the failed entries at once", func() {
+			So(d.WithTargets(Targets{{IMEIPattern: ".*", Backend: b.URL}}), ShouldBeNil)
+			So(q.Handle(&sbd.InformationBucket{Payload: []byte("test")}), ShouldBeNil)
+			So(waitFor(failed), ShouldBeTrue)
+			So(queueEntries(dir), ShouldEqual, 0)
+		})
+		Convey("a message which cannot be rendered should be moved to the failed entries at once", func() {
+			So(d.WithTargets(Targets{{IMEIPattern: ".*", Backend: b.URL, Template: "{{lat .Data.Position}}"}}), ShouldBeNil)
+			So(q.Handle(sampleBucket()), ShouldBeNil)
+			So(waitFor(failed), ShouldBeTrue)
+			So(atomic.LoadInt32(&calls), ShouldEqual, 0)
+		})
+	})
+
+	Convey("only an error whose parts are all permanent should be permanent", t, func() {
+		p := permanent(errors.New("permanent"))
+		So(isPermanent(p), ShouldBeTrue)
+		So(isPermanent(fmt.Errorf("wrapped: %w", p)), ShouldBeTrue)
+		So(isPermanent(errors.Join(p, p)), ShouldBeTrue)
+		So(isPermanent(errors.Join(p, errors.New("temporary"))), ShouldBeFalse)
+		So(isPermanent(errors.New("temporary")), ShouldBeFalse)
+	})
+
+	Convey("a corrupt entry should be moved to the failed entries", t, func() {
+		dir := t.TempDir()
+		So(os.WriteFile(filepath.Join(dir, "00000000000000000001"+queueSuffix), []byte("{"), 0o600), ShouldBeNil)
+		rec := &recordingDistributer{targets: Targets{{ID: "test"}}}
+		q, err := NewQueued(rec, dir, 1, log)
+		So(err, ShouldBeNil)
+		defer q.Close()
+		So(waitFor(func() bool { return queueEntries(filepath.Join(dir, failedDir)) == 1 }), ShouldBeTrue)
+		So(queueEntries(dir), ShouldEqual, 0)
+		So(rec.count(), ShouldEqual, 0)
+	})
+
+	Convey("given a queue with undelivered messages", t, func() {
+		dir := t.TempDir()
+		qu, _, err := openQueue(dir)
+		So(err, ShouldBeNil)
+		_, err = qu.append(sampleBucket())
+		So(err, ShouldBeNil)
+		_, err = qu.append(sampleBucket())
+		So(err, ShouldBeNil)
+
+		Convey("the messages should be delivered when the queue is opened", func() {
+			rec := &recordingDistributer{targets: Targets{{ID: "test"}}}
+			q, err := NewQueued(rec, dir, 1, log)
+			So(err, ShouldBeNil)
+			defer q.Close()
+			So(waitFor(func() bool { return rec.count() == 2 }), ShouldBeTrue)
+			So(waitFor(func() bool { return queueEntries(dir) == 0 }), ShouldBeTrue)
+			rec.mu.Lock()
+			defer rec.mu.Unlock()
+			So(string(rec.received[0].Raw()), ShouldEqual, sampleMsg)
+		})
+	})
+}
@@ -0,0 +1,137 @@
+package mux
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/protegear/sbd"
+)
+
+const (
+	defaultInitialBackoff = 1 * time.Second
+	defaultMaxBackoff     = 30 * time.Second
+)
+
+// defaultRetryStatus are the HTTP status codes which are retried if a
+// target does not configure its own list.
+var defaultRetryStatus = []int{
+	http.StatusRequestTimeout,
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// A RetryPolicy configures how often a failed webhook call is repeated.
+// Network errors are always retried, HTTP responses only if their status
+// is in RetryStatus. The zero value calls the target once.
+type RetryPolicy struct {
+	MaxAttempts    int           `yaml:"maxattempts,omitempty" json:"maxattempts,omitempty"`
+	InitialBackoff time.Duration `yaml:"initialbackoff,omitempty" json:"initialbackoff,omitempty"`
+	MaxBackoff     time.Duration `yaml:"maxbackoff,omitempty" json:"maxbackoff,omitempty"`
+	// Jitter randomizes the backoff by the given fraction, e.g. 0.2
+	// means +/- 20%.
+	Jitter      float64 `yaml:"jitter,omitempty" json:"jitter,omitempty"`
+	RetryStatus []int   `yaml:"retrystatus,omitempty" json:"retrystatus,omitempty"`
+}
+
+func (p *RetryPolicy) validate() error {
+	if p.MaxAttempts < 0 {
+		return fmt.Errorf("maxattempts must not be negative: %d", p.MaxAttempts)
+	}
+	if p.InitialBackoff < 0 || p.MaxBackoff < 0 {
+		return fmt.Errorf("backoff must not be negative")
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("jitter must be in the range 0-1: %v", p.Jitter)
+	}
+	return nil
+}
+
+func (p *RetryPolicy) attempts() int {
+	return max(p.MaxAttempts, 1)
+}
+
+// backoff returns the time to wait after the given failed attempt.
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.InitialBackoff
+	if d == 0 {
+		d = defaultInitialBackoff
+	}
+	maxd := p.MaxBackoff
+	if maxd == 0 {
+		maxd = defaultMaxBackoff
+	}
+	for i := 1; i < attempt && d < maxd; i++ {
+		d *= 2
+	}
+	d = min(d, maxd)
+	if p.Jitter > 0 {
+		d = time.Duration(float64(d) * (1 + p.Jitter*(2*rand.Float64()-1)))
+	}
+	return d
+}
+
+func (p *RetryPolicy) retryable(status int) bool {
+	if len(p.RetryStatus) == 0 {
+		return slices.Contains(defaultRetryStatus, status)
+	}
+	return slices.Contains(p.RetryStatus, status)
+}
+
+// deliver passes the message to the sink of the target until it succeeds,
+// the error is not retryable or the attempts of the retry policy are
+// exhausted. It returns the last error and the number of attempts or
+// errClosed if the distributer is closed before.
+func (f *distributer) deliver(t *Target, js []byte, data *sbd.InformationBucket) (int, error) {
+	body, err := t.render(js, data)
+	if err != nil {
+		f.Error("cannot render body", "target", t.Backend, "error", err)
+		return 1, err
+	}
+	for attempt := 1; ; attempt++ {
+		// the slot is taken first, so a probe which is allowed by the
+		// breaker is always recorded
+		if err := f.acquireSlot(t); err != nil {
+			return attempt, err
+		}
+		if err := t.breaker.allow(time.Now()); err != nil {
+			f.releaseSlot(t)
+			f.Warn("skip target", "target", t.Backend, "error", err)
+			return attempt, err
+		}
+		ctx, cancel := context.WithTimeout(f.ctx, t.timeout())
+		err = t.sink.Deliver(ctx, data, body)
+		cancel()
+		f.releaseSlot(t)
+		t.breaker.record(time.Now(), err)
+		if err == nil {
+			f.Info("data transmitted", "target", t.Backend, "type", t.sinkType(), "attempt", attempt)
+			return attempt, nil
+		}
+		if f.ctx.Err() != nil {
+			return attempt, errClosed
+		}
+		retry := attempt < t.Retry.attempts()
+		if se, ok := err.(*statusError); ok {
+			f.Error("data not transmitted", "target", t.Backend, "status", se.status, "content", se.content, "attempt", attempt)
+			retry = retry && t.Retry.retryable(se.code)
+		} else {
+			f.Error("cannot deliver data", "target", t.Backend, "type", t.sinkType(), "error", err, "attempt", attempt)
+			retry = retry && !isPermanent(err)
+		}
+		if !retry {
+			return attempt, err
+		}
+		select {
+		case <-time.After(t.Retry.backoff(attempt)):
+		case <-f.done:
+			return attempt, errClosed
+		}
+	}
+}
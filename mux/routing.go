@@ -0,0 +1,71 @@
+package mux
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+
+	"github.com/protegear/sbd"
+)
+
+// A Routing decides how many targets receive a message.
+type Routing string
+
+const (
+	// RoutingFanout delivers a message to all matching targets until a
+	// matching target is final.
+	RoutingFanout = Routing("fanout")
+	// RoutingFirstMatch delivers a message only to the first matching
+	// target.
+	RoutingFirstMatch = Routing("first-match")
+)
+
+// ParseRouting returns the routing with the given name. An empty name is
+// the default routing RoutingFanout.
+func ParseRouting(s string) (Routing, error) {
+	switch r := Routing(s); r {
+	case "":
+		return RoutingFanout, nil
+	case RoutingFanout, RoutingFirstMatch:
+		return r, nil
+	}
+	return "", fmt.Errorf("unknown routing %q, use fanout or first-match", s)
+}
+
+// WithRouting sets the routing of the distributer, the default is
+// RoutingFanout.
+func WithRouting(r Routing) Option {
+	return func(f *distributer) {
+		f.routing = r
+	}
+}
+
+// sortTargets orders the targets by descending priority. Targets with the
+// same priority are ordered by their ID and backend, so the order does not
+// depend on the order in which the targets were configured.
+func sortTargets(targets Targets) {
+	slices.SortStableFunc(targets, func(a, b Target) int {
+		return cmp.Or(
+			cmp.Compare(b.Priority, a.Priority),
+			cmp.Compare(a.ID, b.ID),
+			cmp.Compare(a.Backend, b.Backend),
+		)
+	})
+}
+
+// route returns the targets which receive the message in the order of
+// their priority.
+func (f *distributer) route(targets Targets, imei string, data *sbd.InformationBucket) []*Target {
+	var res []*Target
+	for i := range targets {
+		t := &targets[i]
+		if !t.accepts(imei, data) {
+			continue
+		}
+		res = append(res, t)
+		if t.Final || f.routing == RoutingFirstMatch {
+			break
+		}
+	}
+	return res
+}
@@ -0,0 +1,267 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/protegear/sbd"
+)
+
+// A Rule matches messages by their content. All conditions which are set
+// must match. Rules can be combined with And, Or and Not:
+//
+//	match:
+//	  and:
+//	    - payloadprefix: "21"
+//	    - not:
+//	        boundingbox: {minlat: 45, minlng: 5, maxlat: 48, maxlng: 11}
+type Rule struct {
+	And []Rule `yaml:"and,omitempty" json:"and,omitempty"`
+	Or  []Rule `yaml:"or,omitempty" json:"or,omitempty"`
+	Not *Rule  `yaml:"not,omitempty" json:"not,omitempty"`
+
+	SessionStatus []sbd.SessionStatus `yaml:"sessionstatus,omitempty" json:"sessionstatus,omitempty"`
+	HasLocation   *bool               `yaml:"haslocation,omitempty" json:"haslocation,omitempty"`
+	HasPayload    *bool               `yaml:"haspayload,omitempty" json:"haspayload,omitempty"`
+	// PayloadPrefix are the hex encoded first bytes of the payload.
+	PayloadPrefix    string `yaml:"payloadprefix,omitempty" json:"payloadprefix,omitempty"`
+	MinPayloadLength *int   `yaml:"minpayloadlength,omitempty" json:"minpayloadlength,omitempty"`
+	MaxPayloadLength *int   `yaml:"maxpayloadlength,omitempty" json:"maxpayloadlength,omitempty"`
+	// BoundingBox and Polygon match the position of the message, a
+	// message without a position never matches.
+	BoundingBox *BoundingBox `yaml:"boundingbox,omitempty" json:"boundingbox,omitempty"`
+	// Polygon is a list of latitude/longitude pairs.
+	Polygon      [][2]float64 `yaml:"polygon,omitempty" json:"polygon,omitempty"`
+	MaxCEPRadius *int         `yaml:"maxcepradius,omitempty" json:"maxcepradius,omitempty"`
+	// TimeOfDay matches the time of the session.
+	TimeOfDay *TimeOfDay `yaml:"timeofday,omitempty" json:"timeofday,omitempty"`
+}
+
+// A BoundingBox is a rectangle of latitude and longitude values.
+type BoundingBox struct {
+	MinLat float64 `yaml:"minlat" json:"minlat"`
+	MinLng float64 `yaml:"minlng" json:"minlng"`
+	MaxLat float64 `yaml:"maxlat" json:"maxlat"`
+	MaxLng float64 `yaml:"maxlng" json:"maxlng"`
+}
+
+// TimeOfDay is a range like 22:00-06:00 in the given timezone, the default
+// timezone is UTC. The range includes From and excludes To.
+type TimeOfDay struct {
+	From     string `yaml:"from" json:"from"`
+	To       string `yaml:"to" json:"to"`
+	Timezone string `yaml:"timezone,omitempty" json:"timezone,omitempty"`
+}
+
+// A matcher checks if a message matches a compiled rule.
+type matcher func(data *sbd.InformationBucket) bool
+
+func matchAll(*sbd.InformationBucket) bool { return true }
+
+// clone returns a deep copy of the rule.
+func (r *Rule) clone() *Rule {
+	if r == nil {
+		return nil
+	}
+	c := *r
+	c.And = cloneRules(r.And)
+	c.Or = cloneRules(r.Or)
+	c.Not = r.Not.clone()
+	c.SessionStatus = slices.Clone(r.SessionStatus)
+	c.HasLocation = clonePtr(r.HasLocation)
+	c.HasPayload = clonePtr(r.HasPayload)
+	c.MinPayloadLength = clonePtr(r.MinPayloadLength)
+	c.MaxPayloadLength = clonePtr(r.MaxPayloadLength)
+	c.BoundingBox = clonePtr(r.BoundingBox)
+	c.Polygon = slices.Clone(r.Polygon)
+	c.MaxCEPRadius = clonePtr(r.MaxCEPRadius)
+	c.TimeOfDay = clonePtr(r.TimeOfDay)
+	return &c
+}
+
+func cloneRules(rs []Rule) []Rule {
+	if rs == nil {
+		return nil
+	}
+	res := make([]Rule, len(rs))
+	for i := range rs {
+		res[i] = *rs[i].clone()
+	}
+	return res
+}
+
+func clonePtr[T any](p *T) *T {
+	if p == nil {
+		return nil
+	}
+	c := *p
+	return &c
+}
+
+// compile validates the rule and returns its matcher.
+func (r *Rule) compile() (matcher, error) {
+	var ms []matcher
+	add := func(m matcher) { ms = append(ms, m) }
+
+	for _, sub := range r.And {
+		m, err := sub.compile()
+		if err != nil {
+			return nil, err
+		}
+		add(m)
+	}
+	if len(r.Or) > 0 {
+		var ors []matcher
+		for _, sub := range r.Or {
+			m, err := sub.compile()
+			if err != nil {
+				return nil, err
+			}
+			ors = append(ors, m)
+		}
+		add(func(data *sbd.InformationBucket) bool {
+			return slices.ContainsFunc(ors, func(m matcher) bool { return m(data) })
+		})
+	}
+	if r.Not != nil {
+		m, err := r.Not.compile()
+		if err != nil {
+			return nil, err
+		}
+		add(func(data *sbd.InformationBucket) bool { return !m(data) })
+	}
+	if len(r.SessionStatus) > 0 {
+		add(func(data *sbd.InformationBucket) bool {
+			return data.Header != nil && slices.Contains(r.SessionStatus, data.Header.SessionStatus)
+		})
+	}
+	if r.HasLocation != nil {
+		want := *r.HasLocation
+		add(func(data *sbd.InformationBucket) bool { return (data.Location != nil) == want })
+	}
+	if r.HasPayload != nil {
+		want := *r.HasPayload
+		add(func(data *sbd.InformationBucket) bool { return (len(data.Payload) > 0) == want })
+	}
+	if r.PayloadPrefix != "" {
+		prefix, err := hex.DecodeString(strings.TrimPrefix(r.PayloadPrefix, "0x"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid payloadprefix %q: %v", r.PayloadPrefix, err)
+		}
+		add(func(data *sbd.InformationBucket) bool { return bytes.HasPrefix(data.Payload, prefix) })
+	}
+	if r.MinPayloadLength != nil {
+		l := *r.MinPayloadLength
+		add(func(data *sbd.InformationBucket) bool { return len(data.Payload) >= l })
+	}
+	if r.MaxPayloadLength != nil {
+		l := *r.MaxPayloadLength
+		add(func(data *sbd.InformationBucket) bool { return len(data.Payload) <= l })
+	}
+	if r.BoundingBox != nil {
+		bb := *r.BoundingBox
+		if bb.MinLat > bb.MaxLat || bb.MinLng > bb.MaxLng {
+			return nil, fmt.Errorf("invalid boundingbox %+v: min must not be greater than max", bb)
+		}
+		add(func(data *sbd.InformationBucket) bool {
+			p := data.Position
+			return p != nil && p.Latitude >= bb.MinLat && p.Latitude <= bb.MaxLat &&
+				p.Longitude >= bb.MinLng && p.Longitude <= bb.MaxLng
+		})
+	}
+	if len(r.Polygon) > 0 {
+		if len(r.Polygon) < 3 {
+			return nil, fmt.Errorf("a polygon needs at least 3 points, not %d", len(r.Polygon))
+		}
+		poly := slices.Clone(r.Polygon)
+		add(func(data *sbd.InformationBucket) bool {
+			return data.Position != nil && inPolygon(poly, data.Position.Latitude, data.Position.Longitude)
+		})
+	}
+	if r.MaxCEPRadius != nil {
+		cep := *r.MaxCEPRadius
+		add(func(data *sbd.InformationBucket) bool {
+			return data.Location != nil && data.Location.GetCEPRadius() <= cep
+		})
+	}
+	if r.TimeOfDay != nil {
+		m, err := r.TimeOfDay.compile()
+		if err != nil {
+			return nil, err
+		}
+		add(m)
+	}
+
+	switch len(ms) {
+	case 0:
+		return matchAll, nil
+	case 1:
+		return ms[0], nil
+	}
+	return func(data *sbd.InformationBucket) bool {
+		for _, m := range ms {
+			if !m(data) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func (td *TimeOfDay) compile() (matcher, error) {
+	from, err := parseClock(td.From)
+	if err != nil {
+		return nil, err
+	}
+	to, err := parseClock(td.To)
+	if err != nil {
+		return nil, err
+	}
+	loc := time.UTC
+	if td.Timezone != "" {
+		loc, err = time.LoadLocation(td.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone %q: %v", td.Timezone, err)
+		}
+	}
+	return func(data *sbd.InformationBucket) bool {
+		if data.Header == nil {
+			return false
+		}
+		t := data.Header.GetTime().In(loc)
+		now := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+		if from <= to {
+			return now >= from && now < to
+		}
+		// the range wraps around midnight
+		return now >= from || now < to
+	}, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, use HH:MM: %v", s, err)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// inPolygon checks with the ray casting algorithm if the point is inside
+// of the polygon. The points of the polygon are latitude/longitude pairs.
+func inPolygon(poly [][2]float64, lat, lng float64) bool {
+	in := false
+	j := len(poly) - 1
+	for i := range poly {
+		yi, xi := poly[i][0], poly[i][1]
+		yj, xj := poly[j][0], poly[j][1]
+		if (yi > lat) != (yj > lat) && lng < (xj-xi)*(lat-yi)/(yj-yi)+xi {
+			in = !in
+		}
+		j = i
+	}
+	return in
+}
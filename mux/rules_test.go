@@ -0,0 +1,73 @@
+package mux
+
+import (
+	"testing"
+
+	"github.com/protegear/sbd"
+	. "github.com/smartystreets/goconvey/convey"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func compileRule(src string) (matcher, error) {
+	var r Rule
+	if err := yaml.Unmarshal([]byte(src), &r); err != nil {
+		return nil, err
+	}
+	return r.compile()
+}
+
+func TestRules(t *testing.T) {
+	Convey("given a message with payload and position", t, func() {
+		data := sampleBucket()
+		data.Position = &sbd.Location{Latitude: 47.1, Longitude: 8.5}
+		data.Location = &sbd.MOLocationInformation{CEPRadius: 5}
+
+		rules := []struct {
+			Name  string
+			Rule  string
+			Match bool
+		}{
+			{"an empty rule", "{}", true},
+			{"the session status", "sessionstatus: [0, 1]", true},
+			{"another session status", "sessionstatus: [10]", false},
+			{"a payload prefix", "payloadprefix: '7465'", true},
+			{"another payload prefix", "payloadprefix: '0x21'", false},
+			{"the payload length", "{minpayloadlength: 10, maxpayloadlength: 22}", true},
+			{"a too small payload length", "maxpayloadlength: 10", false},
+			{"the existence of a location", "haslocation: true", true},
+			{"a bounding box", "boundingbox: {minlat: 45, minlng: 5, maxlat: 48, maxlng: 11}", true},
+			{"another bounding box", "boundingbox: {minlat: -10, minlng: 5, maxlat: 0, maxlng: 11}", false},
+			{"a polygon", "polygon: [[45, 5], [48, 5], [48, 11], [45, 11]]", true},
+			{"another polygon", "polygon: [[45, 5], [48, 5], [45, 8]]", false},
+			{"the cep radius", "maxcepradius: 10", true},
+			{"a too small cep radius", "maxcepradius: 2", false},
+			// the session time is 2015-07-09 18:15:08 UTC
+			{"the time of day", "timeofday: {from: '18:00', to: '19:00'}", true},
+			{"a time of day over midnight", "timeofday: {from: '22:00', to: '06:00'}", false},
+			{"the time of day in a timezone", "timeofday: {from: '20:00', to: '21:00', timezone: Europe/Berlin}", true},
+			{"a combination with and", "and: [{haspayload: true}, {maxcepradius: 2}]", false},
+			{"a combination with or", "or: [{haspayload: false}, {maxcepradius: 10}]", true},
+			{"a negation", "not: {payloadprefix: '7465'}", false},
+		}
+		for _, r := range rules {
+			Convey("a rule with "+r.Name+" should be evaluated", func() {
+				m, err := compileRule(r.Rule)
+				So(err, ShouldBeNil)
+				So(m(data), ShouldEqual, r.Match)
+			})
+		}
+	})
+	Convey("invalid rules should be rejected", t, func() {
+		for _, r := range []string{
+			"payloadprefix: xyz",
+			"boundingbox: {minlat: 10, maxlat: 5}",
+			"polygon: [[1, 1], [2, 2]]",
+			"timeofday: {from: '25:00', to: '01:00'}",
+			"timeofday: {from: '01:00', to: '02:00', timezone: Nowhere/City}",
+			"not: {payloadprefix: xyz}",
+		} {
+			_, err := compileRule(r)
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
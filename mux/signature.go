@@ -0,0 +1,88 @@
+package mux
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The headers of a signed webhook call.
+const (
+	TimestampHeader = "X-Directip-Timestamp"
+	SignatureHeader = "X-Directip-Signature"
+
+	signaturePrefix = "sha256="
+)
+
+// MaxSignatureAge is the maximal difference between the timestamp of a
+// signed webhook call and the time of the receiver.
+var MaxSignatureAge = 5 * time.Minute
+
+// MaxSignedBody is the maximal size of the body which VerifyWebhook reads.
+var MaxSignedBody int64 = 1 << 20
+
+var (
+	ErrMissingSignature = errors.New("the request is not signed")
+	ErrInvalidSignature = errors.New("the signature of the request is invalid")
+	ErrExpiredSignature = errors.New("the timestamp of the request is too old")
+	ErrBodyTooLarge     = errors.New("the body of the request is too large")
+)
+
+// sign computes the signature of the body with the given timestamp. The
+// signed content is the timestamp, a dot and the body.
+func sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// signRequest sets the timestamp and the signature header of the request.
+func signRequest(rq *http.Request, secret string, body []byte, now time.Time) {
+	ts := strconv.FormatInt(now.Unix(), 10)
+	rq.Header.Set(TimestampHeader, ts)
+	rq.Header.Set(SignatureHeader, sign(secret, ts, body))
+}
+
+// VerifyWebhook checks the signature of a webhook call of a target with
+// the given secret. The body of the request is read and replaced, so the
+// handler can read it again.
+func VerifyWebhook(r *http.Request, secret string) error {
+	ts := r.Header.Get(TimestampHeader)
+	sig := r.Header.Get(SignatureHeader)
+	if ts == "" || sig == "" {
+		return ErrMissingSignature
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %q: %w", ts, ErrInvalidSignature)
+	}
+	if age := time.Since(time.Unix(unix, 0)).Abs(); age > MaxSignatureAge {
+		return ErrExpiredSignature
+	}
+	var body []byte
+	if r.Body != nil {
+		body, err = io.ReadAll(io.LimitReader(r.Body, MaxSignedBody+1))
+		r.Body.Close()
+		if err != nil {
+			return fmt.Errorf("cannot read body: %w", err)
+		}
+		if int64(len(body)) > MaxSignedBody {
+			return ErrBodyTooLarge
+		}
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if !strings.HasPrefix(sig, signaturePrefix) || !hmac.Equal([]byte(sig), []byte(sign(secret, ts, body))) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSignedWebhook(t *testing.T) {
+	Convey("given a backend which verifies the signature", t, func() {
+		verified := make(chan error, 1)
+		var body []byte
+		b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			err := VerifyWebhook(r, "secret")
+			body, _ = io.ReadAll(r.Body)
+			verified <- err
+			if err != nil {
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		}))
+		defer b.Close()
+		d := New(1, testLogger())
+		defer d.Close()
+
+		Convey("a target with the same secret should be accepted", func() {
+			So(d.WithTargets(Targets{{IMEIPattern: ".*", Backend: b.URL, Secret: "secret"}}), ShouldBeNil)
+			So(d.Handle(sampleBucket()), ShouldBeNil)
+			So(<-verified, ShouldBeNil)
+			So(json.Valid(body), ShouldBeTrue)
+		})
+		Convey("a target with another secret should be rejected", func() {
+			So(d.WithTargets(Targets{{IMEIPattern: ".*", Backend: b.URL, Secret: "other"}}), ShouldBeNil)
+			So(d.Handle(sampleBucket()), ShouldNotBeNil)
+			So(<-verified, ShouldEqual, ErrInvalidSignature)
+		})
+		Convey("a target without a secret should be rejected", func() {
+			So(d.WithTargets(Targets{{IMEIPattern: ".*", Backend: b.URL}}), ShouldBeNil)
+			So(d.Handle(sampleBucket()), ShouldNotBeNil)
+			So(<-verified, ShouldEqual, ErrMissingSignature)
+		})
+	})
+	Convey("given a signed request", t, func() {
+		body := []byte(`{"payload":"dGVzdA=="}`)
+		rq := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+
+		Convey("a changed body should be rejected", func() {
+			signRequest(rq, "secret", []byte(`{"payload":"ZmFrZQ=="}`), time.Now())
+			So(VerifyWebhook(rq, "secret"), ShouldEqual, ErrInvalidSignature)
+		})
+		Convey("an old timestamp should be rejected", func() {
+			signRequest(rq, "secret", body, time.Now().Add(-time.Hour))
+			So(VerifyWebhook(rq, "secret"), ShouldEqual, ErrExpiredSignature)
+		})
+		Convey("a too large body should be rejected", func() {
+			large := bytes.Repeat([]byte("x"), int(MaxSignedBody)+1)
+			rq := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(large))
+			signRequest(rq, "secret", large, time.Now())
+			So(VerifyWebhook(rq, "secret"), ShouldEqual, ErrBodyTooLarge)
+		})
+		Convey("the body should be readable after the verification", func() {
+			signRequest(rq, "secret", body, time.Now())
+			So(VerifyWebhook(rq, "secret"), ShouldBeNil)
+			content, err := io.ReadAll(rq.Body)
+			So(err, ShouldBeNil)
+			So(content, ShouldResemble, body)
+		})
+	})
+	Convey("given a dead letter of a signed target with a header", t, func() {
+		var calls int32
+		b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&calls, 1) == 1 || r.Header.Get("Authorization") != "Bearer token" || VerifyWebhook(r, "secret") != nil {
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		}))
+		defer b.Close()
+		dir := t.TempDir()
+		dl, err := OpenDeadLetters(dir)
+		So(err, ShouldBeNil)
+		d := New(1, testLogger(), WithDeadLetters(dl))
+		defer d.Close()
+		targets := Targets{{ID: "signed", IMEIPattern: ".*", Backend: b.URL, Secret: "secret", Header: map[string]string{"Authorization": "Bearer token"}}}
+		So(d.WithTargets(targets), ShouldBeNil)
+		So(d.Handle(sampleBucket()), ShouldBeNil)
+		letters, err := dl.List()
+		So(err, ShouldBeNil)
+		So(letters, ShouldHaveLength, 1)
+
+		Convey("the secret and the header values should not be stored", func() {
+			content, err := os.ReadFile(filepath.Join(dir, letters[0].ID+queueSuffix))
+			So(err, ShouldBeNil)
+			So(string(content), ShouldNotContainSubstring, "secret\"")
+			So(string(content), ShouldNotContainSubstring, "token")
+			So(letters[0].Signed, ShouldBeTrue)
+			So(letters[0].HeaderNames, ShouldResemble, []string{"Authorization"})
+		})
+		Convey("a redrive should fail without the configured target", func() {
+			So(dl.Redrive(letters[0], nil, testLogger()), ShouldNotBeNil)
+			So(atomic.LoadInt32(&calls), ShouldEqual, 1)
+		})
+		Convey("a redrive should use the configured secret and header", func() {
+			So(dl.Redrive(letters[0], targets, testLogger()), ShouldBeNil)
+			So(atomic.LoadInt32(&calls), ShouldEqual, 2)
+		})
+	})
+	Convey("the secret should not be logged", t, func() {
+		var buf bytes.Buffer
+		log := slog.New(slog.NewTextHandler(&buf, nil))
+		log.Info("targets", "targets", Targets{{Backend: "http://localhost", Secret: "topsecret"}})
+		So(buf.String(), ShouldNotContainSubstring, "topsecret")
+		So(strings.Contains(buf.String(), "***"), ShouldBeTrue)
+	})
+}
@@ -0,0 +1,227 @@
+package mux
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/protegear/sbd"
+)
+
+// The types of the targets.
+const (
+	TypeHTTP     = "http"
+	TypeNATS     = "nats"
+	TypeMQTT     = "mqtt"
+	TypeDirectIP = "directip"
+	TypeFile     = "file"
+	TypeExec     = "exec"
+)
+
+// A Sink delivers a message to a target. The body is the JSON encoded
+// message or the rendered template of the target, data is the parsed
+// message.
+type Sink interface {
+	Deliver(ctx context.Context, data *sbd.InformationBucket, body []byte) error
+	Close() error
+}
+
+// newSink creates the sink for the type of the target. Sinks which need a
+// connection connect when the first message is delivered.
+func newSink(t *Target) (Sink, error) {
+	switch t.Type {
+	case "", TypeHTTP:
+		return newHTTPSink(t)
+	case TypeNATS:
+		return newNATSSink(t)
+	case TypeMQTT:
+		return newMQTTSink(t)
+	case TypeDirectIP:
+		return newDirectIPSink(t)
+	case TypeFile:
+		return newFileSink(t)
+	case TypeExec:
+		return newExecSink(t)
+	}
+	return nil, fmt.Errorf("unknown target type %q", t.Type)
+}
+
+func (t *Target) sinkType() string {
+	if t.Type == "" {
+		return TypeHTTP
+	}
+	return t.Type
+}
+
+// sinkKey identifies the configuration of a sink, so a sink can be reused
+// when the targets are reconfigured.
+func (t *Target) sinkKey() string {
+	return fmt.Sprintf("%s|%s|%s|%s|%q|%v|%v|%s|%+v|%d|%+v|%s", t.ID, t.sinkType(), t.Backend, t.Topic, t.Command, t.SkipTLS, t.Header, t.Secret, t.TLS, t.MaxConcurrency, t.Breaker, t.ContentType)
+}
+
+// topicData is the data which can be used in the templates of the topic,
+// the file name or the body.
+type topicData struct {
+	IMEI string
+	Data *sbd.InformationBucket
+}
+
+// topicTemplate parses a template like "sbd/{{.IMEI}}".
+func topicTemplate(name, s string) (*template.Template, error) {
+	tpl, err := template.New(name).Option("missingkey=error").Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s template %q: %v", name, s, err)
+	}
+	return tpl, nil
+}
+
+func newTopicData(data *sbd.InformationBucket) topicData {
+	td := topicData{Data: data}
+	if data.Header != nil {
+		td.IMEI = strings.TrimRight(data.Header.GetIMEI(), "\x00")
+	}
+	return td
+}
+
+// errInvalidIMEI is returned when a topic or a file name should be
+// rendered for a message whose IMEI is not a number with 15 digits. The
+// IMEI comes from the network, so it could change the path or the topic.
+var errInvalidIMEI = errors.New("the IMEI is not a number with 15 digits")
+
+func validIMEI(imei string) bool {
+	if len(imei) != 15 {
+		return false
+	}
+	for _, c := range imei {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func renderTopic(tpl *template.Template, data *sbd.InformationBucket) (string, error) {
+	td := newTopicData(data)
+	if !validIMEI(td.IMEI) {
+		return "", permanent(fmt.Errorf("%w: %q", errInvalidIMEI, td.IMEI))
+	}
+	var b strings.Builder
+	if err := tpl.Execute(&b, td); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// A statusError is returned when a webhook answers with a non 2xx status.
+type statusError struct {
+	status  string
+	code    int
+	content string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("data not transmitted: %s", e.status)
+}
+
+// httpSink posts the message to a webhook. If the target has TLS files,
+// the client is created again when the files change.
+type httpSink struct {
+	target Target
+
+	mu     sync.Mutex
+	client *http.Client
+	state  string
+}
+
+func newHTTPSink(t *Target) (*httpSink, error) {
+	u, err := url.Parse(t.Backend)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook url: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("the webhook url must be an absolute http(s) url")
+	}
+	s := &httpSink{target: *t}
+	if _, err := s.currentClient(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// currentClient returns the client for the current TLS files. If the
+// changed files cannot be loaded, e.g. because they are written right
+// now, the previous client is used.
+func (s *httpSink) currentClient() (*http.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, err := s.target.TLS.fileState()
+	if err == nil && s.client != nil && state == s.state {
+		return s.client, nil
+	}
+	var cfg *tls.Config
+	if err == nil {
+		cfg, err = s.target.TLS.load(s.target.SkipTLS)
+	}
+	if err != nil {
+		if s.client != nil {
+			return s.client, nil
+		}
+		return nil, err
+	}
+	if s.client != nil {
+		s.client.CloseIdleConnections()
+	}
+	s.client = &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+	s.state = state
+	return s.client, nil
+}
+
+func (s *httpSink) Deliver(ctx context.Context, data *sbd.InformationBucket, body []byte) error {
+	t := &s.target
+	rq, err := http.NewRequestWithContext(ctx, http.MethodPost, t.Backend, bytes.NewBuffer(body))
+	if err != nil {
+		return fmt.Errorf("cannot create request: %w", err)
+	}
+	rq.Header.Add("Content-Type", t.contentType())
+	for k, v := range t.Header {
+		rq.Header.Add(k, v)
+	}
+	start := time.Now()
+	if t.Secret != "" {
+		signRequest(rq, t.Secret, body, start)
+	}
+	client, err := s.currentClient()
+	if err != nil {
+		return err
+	}
+	rsp, err := client.Do(rq)
+	if err != nil {
+		observeWebhook(t, start, 0, err)
+		return fmt.Errorf("cannot call webhook: %w", err)
+	}
+	defer rsp.Body.Close()
+	content, _ := io.ReadAll(rsp.Body)
+	observeWebhook(t, start, rsp.StatusCode, nil)
+	if rsp.StatusCode/100 != 2 {
+		return &statusError{status: rsp.Status, code: rsp.StatusCode, content: string(content)}
+	}
+	return nil
+}
+
+func (s *httpSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client != nil {
+		s.client.CloseIdleConnections()
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package mux
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/protegear/sbd"
+)
+
+// errNegativeAck is returned when the downstream receiver does not
+// acknowledge a relayed message.
+var errNegativeAck = errors.New("message not acknowledged by the directip receiver")
+
+// directIPSink relays the message as a directip MO message to the
+// host:port of the backend. A received message is relayed byte by byte,
+// other messages (e.g. from a dead letter) are encoded again.
+type directIPSink struct {
+	address string
+}
+
+func newDirectIPSink(t *Target) (*directIPSink, error) {
+	if _, _, err := net.SplitHostPort(t.Backend); err != nil {
+		return nil, fmt.Errorf("a directip target needs host:port as backend (%q): %v", t.Backend, err)
+	}
+	return &directIPSink{address: t.Backend}, nil
+}
+
+func (s *directIPSink) Deliver(ctx context.Context, data *sbd.InformationBucket, body []byte) error {
+	var conf *sbd.MOConfirmationMessage
+	var err error
+	if raw := data.Raw(); raw != nil {
+		conf, err = sbd.SendRawMO(ctx, s.address, raw)
+	} else {
+		conf, err = sbd.SendMO(ctx, s.address, data)
+	}
+	if err != nil {
+		return err
+	}
+	if !conf.Success() {
+		return errNegativeAck
+	}
+	return nil
+}
+
+func (s *directIPSink) Close() error {
+	return nil
+}
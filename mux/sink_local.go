@@ -0,0 +1,89 @@
+package mux
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"text/template"
+
+	"github.com/protegear/sbd"
+)
+
+// fileSink appends every message as a JSON line to a file. The backend
+// is the name of the file and can be a template like
+// /var/archive/{{.IMEI}}.jsonl.
+type fileSink struct {
+	name *template.Template
+	mu   sync.Mutex
+}
+
+func newFileSink(t *Target) (*fileSink, error) {
+	if t.Backend == "" {
+		return nil, errors.New("a file target needs a file name as backend")
+	}
+	tpl, err := topicTemplate("file", t.Backend)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSink{name: tpl}, nil
+}
+
+func (s *fileSink) Deliver(ctx context.Context, data *sbd.InformationBucket, body []byte) error {
+	name, err := renderTopic(s.name, data)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(name), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(bytes.TrimRight(body, "\n"), '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s *fileSink) Close() error {
+	return nil
+}
+
+// execSink starts the command of the target for every message and writes
+// the message to its stdin. The delivery fails if the command fails.
+type execSink struct {
+	command []string
+}
+
+func newExecSink(t *Target) (*execSink, error) {
+	if len(t.Command) == 0 {
+		return nil, errors.New("an exec target needs a command")
+	}
+	return &execSink{command: t.Command}, nil
+}
+
+func (s *execSink) Deliver(ctx context.Context, data *sbd.InformationBucket, body []byte) error {
+	cmd := exec.CommandContext(ctx, s.command[0], s.command[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("command %q failed: %v: %s", s.command[0], err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+func (s *execSink) Close() error {
+	return nil
+}
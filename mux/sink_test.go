@@ -0,0 +1,165 @@
+package mux
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/protegear/sbd"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSinks(t *testing.T) {
+	Convey("given a distributer", t, func() {
+		d := New(1, testLogger())
+		defer d.Close()
+
+		Convey("a file target should append the message to a file per IMEI", func() {
+			dir := t.TempDir()
+			So(d.WithTargets(Targets{{IMEIPattern: ".*", Type: TypeFile, Backend: filepath.Join(dir, "{{.IMEI}}.jsonl")}}), ShouldBeNil)
+			So(d.Handle(sampleBucket()), ShouldBeNil)
+			So(d.Handle(sampleBucket()), ShouldBeNil)
+			content, err := os.ReadFile(filepath.Join(dir, "300234063904190.jsonl"))
+			So(err, ShouldBeNil)
+			lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+			So(lines, ShouldHaveLength, 2)
+			So(lines[0], ShouldContainSubstring, `"imei":"300234063904190"`)
+		})
+		Convey("a file target should reject an IMEI which leaves the directory", func() {
+			base := t.TempDir()
+			dir := filepath.Join(base, "a", "b")
+			So(d.WithTargets(Targets{{IMEIPattern: ".*", Type: TypeFile, Backend: filepath.Join(dir, "{{.IMEI}}", "sbd.jsonl")}}), ShouldBeNil)
+			msg := sampleBucket()
+			copy(msg.Header.IMEI[:], "../../x00000000")
+			err := d.Handle(msg)
+			So(errors.Is(err, errInvalidIMEI), ShouldBeTrue)
+			_, err = os.Stat(filepath.Join(base, "x00000000"))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+		Convey("a topic should not be changed by the IMEI", func() {
+			tpl, err := topicTemplate("topic", "sbd/{{.IMEI}}")
+			So(err, ShouldBeNil)
+			msg := sampleBucket()
+			for _, imei := range []string{"30023406390419#", "30023406390419+", "3002340639.4190", "30023406390419>", "3002340639041"} {
+				msg.Header.IMEI = [15]byte{}
+				copy(msg.Header.IMEI[:], imei)
+				_, err := renderTopic(tpl, msg)
+				So(errors.Is(err, errInvalidIMEI), ShouldBeTrue)
+			}
+			topic, err := renderTopic(tpl, sampleBucket())
+			So(err, ShouldBeNil)
+			So(topic, ShouldEqual, "sbd/300234063904190")
+		})
+		Convey("an exec target should pass the message on stdin", func() {
+			out := filepath.Join(t.TempDir(), "out")
+			So(d.WithTargets(Targets{{IMEIPattern: ".*", Type: TypeExec, Command: []string{"sh", "-c", "cat > " + out}}}), ShouldBeNil)
+			So(d.Handle(sampleBucket()), ShouldBeNil)
+			content, err := os.ReadFile(out)
+			So(err, ShouldBeNil)
+			So(string(content), ShouldContainSubstring, `"imei":"300234063904190"`)
+		})
+		Convey("a failing command should not acknowledge", func() {
+			So(d.WithTargets(Targets{{IMEIPattern: ".*", Type: TypeExec, Command: []string{"false"}}}), ShouldBeNil)
+			So(d.Handle(sampleBucket()), ShouldNotBeNil)
+		})
+		Convey("a directip target should relay the message", func() {
+			received := make(chan *sbd.InformationBucket, 1)
+			srv := &sbd.Server{Handler: sbd.HandlerFunc(func(data *sbd.InformationBucket) error {
+				received <- data
+				return nil
+			})}
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			go srv.Serve(context.Background(), l)
+			defer srv.Shutdown(context.Background())
+
+			So(d.WithTargets(Targets{{IMEIPattern: ".*", Type: TypeDirectIP, Backend: l.Addr().String()}}), ShouldBeNil)
+			So(d.Handle(sampleBucket()), ShouldBeNil)
+			data := <-received
+			So(data.Header.GetIMEI(), ShouldEqual, sampleBucket().Header.GetIMEI())
+			So(data.Payload, ShouldResemble, sampleBucket().Payload)
+		})
+		Convey("a directip target should relay a received message byte by byte", func() {
+			// sample message with an unknown element between header and payload
+			msg := "\x01\x00\x3e\x01\x00\x1cp\xec\ai300234063904190\x00\x00K\x00\x00U\x9e\xba,\x09\x00\x03abc\x02\x00\x16test message0123456789"
+			received := make(chan []byte, 1)
+			srv := &sbd.Server{Handler: sbd.HandlerFunc(func(data *sbd.InformationBucket) error {
+				received <- data.Raw()
+				return nil
+			})}
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			go srv.Serve(context.Background(), l)
+			defer srv.Shutdown(context.Background())
+
+			data, err := sbd.GetElements(strings.NewReader(msg))
+			So(err, ShouldBeNil)
+			So(d.WithTargets(Targets{{IMEIPattern: "^3002340639.*", Type: TypeDirectIP, Backend: l.Addr().String()}}), ShouldBeNil)
+			So(d.Handle(data), ShouldBeNil)
+			So(string(<-received), ShouldEqual, msg)
+		})
+		Convey("a directip target which nacks should not acknowledge", func() {
+			srv := &sbd.Server{Handler: sbd.HandlerFunc(func(data *sbd.InformationBucket) error {
+				return errors.New("rejected")
+			})}
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			go srv.Serve(context.Background(), l)
+			defer srv.Shutdown(context.Background())
+
+			So(d.WithTargets(Targets{{IMEIPattern: ".*", Type: TypeDirectIP, Backend: l.Addr().String()}}), ShouldBeNil)
+			So(d.Handle(sampleBucket()), ShouldNotBeNil)
+		})
+	})
+	Convey("given a nats server which does not answer", t, func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer l.Close()
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer c.Close()
+			}
+		}()
+		s, err := newNATSSink(&Target{Type: TypeNATS, Backend: "nats://" + l.Addr().String(), Topic: "sbd"})
+		So(err, ShouldBeNil)
+
+		Convey("the connect should end with the context", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			So(s.Deliver(ctx, sampleBucket(), nil), ShouldNotBeNil)
+			So(time.Since(start), ShouldBeLessThan, time.Second)
+		})
+		Convey("the connect should not block the close", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			res := make(chan error, 1)
+			go func() { res <- s.Deliver(ctx, sampleBucket(), nil) }()
+			time.Sleep(50 * time.Millisecond)
+			start := time.Now()
+			So(s.Close(), ShouldBeNil)
+			So(time.Since(start), ShouldBeLessThan, 100*time.Millisecond)
+			So(<-res, ShouldNotBeNil)
+		})
+	})
+	Convey("invalid sink configurations should be rejected", t, func() {
+		d := New(1, testLogger())
+		defer d.Close()
+		So(d.WithTargets(Targets{{IMEIPattern: ".*", Type: "smtp"}}), ShouldNotBeNil)
+		So(d.WithTargets(Targets{{IMEIPattern: ".*", Backend: "localhost:8080/sbd"}}), ShouldNotBeNil)
+		So(d.WithTargets(Targets{{IMEIPattern: ".*", Backend: "ftp://localhost/sbd"}}), ShouldNotBeNil)
+		So(d.WithTargets(Targets{{IMEIPattern: ".*", Type: TypeExec}}), ShouldNotBeNil)
+		So(d.WithTargets(Targets{{IMEIPattern: ".*", Type: TypeNATS, Backend: "nats://localhost:4222"}}), ShouldNotBeNil)
+		So(d.WithTargets(Targets{{IMEIPattern: ".*", Type: TypeMQTT, Backend: "tcp://localhost:1883", Topic: "sbd/{{.IMEI"}}), ShouldNotBeNil)
+		So(d.WithTargets(Targets{{IMEIPattern: ".*", Type: TypeDirectIP, Backend: "localhost"}}), ShouldNotBeNil)
+	})
+}
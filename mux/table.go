@@ -0,0 +1,169 @@
+package mux
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"sync/atomic"
+)
+
+// A routingTable is an immutable snapshot of the configured targets. The
+// distributer swaps the current table atomically, so every message sees
+// the targets of exactly one configuration. The table counts its users;
+// when the last message which uses a replaced table is done, the sinks
+// which are not used by a newer table are closed.
+type routingTable struct {
+	targets Targets
+	sinks   []*sharedSink
+	refs    atomic.Int64
+}
+
+// A sharedSink is used by all tables which contain a target with the same
+// sink configuration, so connections survive a reconfiguration. The
+// configuration contains the ID and the backend, so all targets which
+// share the sink and its breaker have the same label in the health and
+// the metrics.
+type sharedSink struct {
+	Sink
+	key     string
+	refs    int
+	slots   chan struct{}
+	breaker *breaker
+}
+
+// acquire returns the current table and increments its reference count.
+// The table must be released when the message is done. A replaced table
+// whose last reference is gone is never returned again.
+func (f *distributer) acquire() *routingTable {
+	for {
+		t := f.table.Load()
+		if t == nil {
+			return nil
+		}
+		r := t.refs.Load()
+		if r > 0 && t.refs.CompareAndSwap(r, r+1) {
+			return t
+		}
+	}
+}
+
+// release decrements the reference count of the table and releases its
+// sinks when it is not used anymore.
+func (f *distributer) release(t *routingTable) {
+	if t == nil || t.refs.Add(-1) > 0 {
+		return
+	}
+	f.releaseSinks(t.sinks)
+}
+
+// newTable prepares the targets and creates a table for them.
+func (f *distributer) newTable(targets Targets) (*routingTable, error) {
+	table := &routingTable{}
+	for _, t := range targets {
+		// the caller must not change the targets of the table
+		t = t.clone()
+		if err := t.prepare(); err != nil {
+			f.releaseSinks(table.sinks)
+			return nil, err
+		}
+		s, err := f.acquireSink(&t)
+		if err != nil {
+			f.releaseSinks(table.sinks)
+			return nil, err
+		}
+		t.sink = s
+		t.slots = s.slots
+		t.breaker = s.breaker
+		table.sinks = append(table.sinks, s)
+		table.targets = append(table.targets, t)
+	}
+	sortTargets(table.targets)
+	table.refs.Store(1)
+	return table, nil
+}
+
+// acquireSink returns the sink for the target and increments its reference
+// count. Sinks with the same configuration are reused.
+func (f *distributer) acquireSink(t *Target) (*sharedSink, error) {
+	f.sinkLock.Lock()
+	defer f.sinkLock.Unlock()
+	key := t.sinkKey()
+	if s, ok := f.sinks[key]; ok {
+		s.refs++
+		return s, nil
+	}
+	s, err := newSink(t)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target %q: %v", t.Backend, err)
+	}
+	ss := &sharedSink{Sink: s, key: key, refs: 1, breaker: newBreaker(t)}
+	if t.MaxConcurrency > 0 {
+		ss.slots = make(chan struct{}, t.MaxConcurrency)
+	}
+	f.sinks[key] = ss
+	return ss, nil
+}
+
+// releaseSinks decrements the reference counts of the sinks and closes the
+// sinks which are not used anymore.
+func (f *distributer) releaseSinks(sinks []*sharedSink) {
+	var unused []*sharedSink
+	f.sinkLock.Lock()
+	for _, s := range sinks {
+		s.refs--
+		if s.refs == 0 {
+			delete(f.sinks, s.key)
+			unused = append(unused, s)
+		}
+	}
+	f.sinkLock.Unlock()
+	for _, s := range unused {
+		if err := s.Close(); err != nil {
+			f.Error("cannot close sink", "error", err)
+		}
+	}
+}
+
+// Targets returns a deep copy of the current targets.
+func (f *distributer) Targets() Targets {
+	t := f.acquire()
+	defer f.release(t)
+	if t == nil {
+		return nil
+	}
+	res := make(Targets, len(t.targets))
+	for i, tg := range t.targets {
+		res[i] = tg.clone()
+	}
+	return res
+}
+
+// clone returns a copy of the target which shares no configuration with
+// the target.
+func (t Target) clone() Target {
+	t.Header = maps.Clone(t.Header)
+	t.Retry.RetryStatus = slices.Clone(t.Retry.RetryStatus)
+	t.TLS = clonePtr(t.TLS)
+	t.Match = t.Match.clone()
+	t.Command = slices.Clone(t.Command)
+	return t
+}
+
+// WithTargets replaces the targets. Messages which are already handled
+// are delivered to the previous targets.
+func (f *distributer) WithTargets(targets Targets) error {
+	f.configLock.Lock()
+	defer f.configLock.Unlock()
+	if f.table.Load() == nil {
+		return errClosed
+	}
+	table, err := f.newTable(targets)
+	if err != nil {
+		return err
+	}
+	f.release(f.table.Swap(table))
+	configuredTargets.Set(float64(len(table.targets)))
+	publishStates(table.targets)
+	f.Info("set config", "config", table.targets)
+	return nil
+}
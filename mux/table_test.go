@@ -0,0 +1,140 @@
+package mux
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// generationBackend records the generation header of every delivery by
+// the MOMSN of the message.
+type generationBackend struct {
+	mu          sync.Mutex
+	generations map[uint16][]string
+}
+
+func (g *generationBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var msg struct {
+		Header struct {
+			MOMSN uint16 `json:"momsn"`
+		} `json:"header"`
+	}
+	json.NewDecoder(r.Body).Decode(&msg)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.generations[msg.Header.MOMSN] = append(g.generations[msg.Header.MOMSN], r.Header.Get("X-Generation"))
+}
+
+func TestConcurrentReconfiguration(t *testing.T) {
+	Convey("given a distributer which is reconfigured while it delivers messages", t, func() {
+		gb := &generationBackend{generations: make(map[uint16][]string)}
+		b := httptest.NewServer(gb)
+		defer b.Close()
+		d := New(4, testLogger())
+		defer d.Close()
+
+		config := func(gen int) Targets {
+			h := map[string]string{"X-Generation": fmt.Sprint(gen)}
+			return Targets{
+				{ID: "a", IMEIPattern: ".*", Backend: b.URL + "/a", Header: h},
+				{ID: "b", IMEIPattern: ".*", Backend: b.URL + "/b", Header: h},
+			}
+		}
+		So(d.WithTargets(config(0)), ShouldBeNil)
+
+		const messages = 200
+		var wg sync.WaitGroup
+		errs := make(chan error, messages)
+		for i := 0; i < messages; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				data := sampleBucket()
+				data.Header.MOMSN = uint16(i)
+				errs <- d.Handle(data)
+			}()
+		}
+		for gen := 1; gen <= 50; gen++ {
+			if err := d.WithTargets(config(gen)); err != nil {
+				panic(err)
+			}
+			d.Targets()
+		}
+		wg.Wait()
+		close(errs)
+
+		Convey("every message should be delivered", func() {
+			for err := range errs {
+				So(err, ShouldBeNil)
+			}
+			So(gb.generations, ShouldHaveLength, messages)
+		})
+		Convey("every message should see the targets of one configuration", func() {
+			for _, gens := range gb.generations {
+				So(gens, ShouldHaveLength, 2)
+				So(gens[0], ShouldEqual, gens[1])
+			}
+		})
+		Convey("only the sinks of the current configuration should be open", func() {
+			f := d.(*distributer)
+			f.sinkLock.Lock()
+			defer f.sinkLock.Unlock()
+			So(f.sinks, ShouldHaveLength, 2)
+		})
+	})
+	Convey("the returned targets should not change the configuration", t, func() {
+		d := New(1, testLogger())
+		defer d.Close()
+		So(d.WithTargets(Targets{{ID: "a", IMEIPattern: ".*", Backend: "http://localhost/a"}}), ShouldBeNil)
+		targets := d.Targets()
+		targets[0].Backend = "http://localhost/b"
+		So(d.Targets()[0].Backend, ShouldEqual, "http://localhost/a")
+	})
+	Convey("the targets of the table should not share their configuration", t, func() {
+		d := New(1, testLogger())
+		defer d.Close()
+		haspayload := true
+		targets := Targets{{
+			ID:          "a",
+			IMEIPattern: ".*",
+			Backend:     "https://localhost/a",
+			Header:      map[string]string{"X-Test": "a"},
+			TLS:         &TLSConfig{ServerName: "a"},
+			Match:       &Rule{HasPayload: &haspayload, Or: []Rule{{PayloadPrefix: "01"}}},
+		}}
+		So(d.WithTargets(targets), ShouldBeNil)
+		targets[0].Header["X-Test"] = "b"
+		haspayload = false
+
+		got := d.Targets()
+		got[0].Header["X-Test"] = "c"
+		got[0].TLS.ServerName = "c"
+		*got[0].Match.HasPayload = false
+		got[0].Match.Or[0].PayloadPrefix = "02"
+
+		current := d.Targets()[0]
+		So(current.Header["X-Test"], ShouldEqual, "a")
+		So(current.TLS.ServerName, ShouldEqual, "a")
+		So(*current.Match.HasPayload, ShouldBeTrue)
+		So(current.Match.Or[0].PayloadPrefix, ShouldEqual, "01")
+	})
+	Convey("targets which share a sink should report the same health", t, func() {
+		d := New(1, testLogger())
+		defer d.Close()
+		So(d.WithTargets(Targets{
+			{ID: "a", IMEIPattern: "^30", Backend: "http://localhost/a"},
+			{ID: "a", IMEIPattern: "^31", Backend: "http://localhost/a", Priority: 1},
+			{ID: "b", IMEIPattern: ".*", Backend: "http://localhost/a"},
+		}), ShouldBeNil)
+		h := d.Health()
+		So(h, ShouldHaveLength, 3)
+		So(h[0].Target, ShouldEqual, "a")
+		So(h[1].Target, ShouldEqual, "a")
+		So(h[2].Target, ShouldEqual, "b")
+	})
+}
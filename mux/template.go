@@ -0,0 +1,82 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"text/template"
+	"time"
+
+	"github.com/protegear/sbd"
+)
+
+const defaultContentType = "application/json"
+
+// bodyFuncs are the helpers which can be used in the body template of a
+// target.
+var bodyFuncs = template.FuncMap{
+	"hex":    hex.EncodeToString,
+	"base64": base64.StdEncoding.EncodeToString,
+	"iso":    isoTime,
+	"lat":    latitude,
+	"lng":    longitude,
+	"json":   toJSON,
+}
+
+// isoTime formats the time in UTC as RFC 3339, e.g. the time of the
+// session with {{iso .Data.Header.GetTime}}.
+func isoTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+func latitude(p *sbd.Location) (float64, error) {
+	if p == nil {
+		return 0, fmt.Errorf("the message contains no position")
+	}
+	return p.Latitude, nil
+}
+
+func longitude(p *sbd.Location) (float64, error) {
+	if p == nil {
+		return 0, fmt.Errorf("the message contains no position")
+	}
+	return p.Longitude, nil
+}
+
+// toJSON encodes the value as JSON, so strings can be embedded safely in
+// a JSON body.
+func toJSON(v any) (string, error) {
+	js, err := json.Marshal(v)
+	return string(js), err
+}
+
+// bodyTemplate parses the template of the body of a target.
+func bodyTemplate(s string) (*template.Template, error) {
+	tpl, err := template.New("body").Option("missingkey=error").Funcs(bodyFuncs).Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid body template: %v", err)
+	}
+	return tpl, nil
+}
+
+// render returns the body for the target. Without a template it is the
+// JSON encoded message.
+func (t *Target) render(js []byte, data *sbd.InformationBucket) ([]byte, error) {
+	if t.body == nil {
+		return js, nil
+	}
+	var b bytes.Buffer
+	if err := t.body.Execute(&b, newTopicData(data)); err != nil {
+		return nil, permanent(fmt.Errorf("cannot render body: %v", err))
+	}
+	return b.Bytes(), nil
+}
+
+func (t *Target) contentType() string {
+	if t.ContentType != "" {
+		return t.ContentType
+	}
+	return defaultContentType
+}
@@ -0,0 +1,53 @@
+package mux
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/protegear/sbd"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTemplate(t *testing.T) {
+	Convey("given a webhook which records the body", t, func() {
+		var body, contentType string
+		b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			data, _ := io.ReadAll(r.Body)
+			body = string(data)
+			contentType = r.Header.Get("Content-Type")
+		}))
+		defer b.Close()
+		d := New(1, testLogger())
+		defer d.Close()
+
+		Convey("a target with a template should receive the rendered body", func() {
+			So(d.WithTargets(Targets{{
+				IMEIPattern: ".*",
+				Backend:     b.URL,
+				Template:    `{"imei":{{json .IMEI}},"time":"{{iso .Data.Header.GetTime}}","hex":"{{hex .Data.Payload}}","lat":{{lat .Data.Position}},"lng":{{lng .Data.Position}}}`,
+				ContentType: "application/vnd.tracker+json",
+			}}), ShouldBeNil)
+			msg := sampleBucket()
+			msg.Position = &sbd.Location{Latitude: 48.5, Longitude: -11.25}
+			So(d.Handle(msg), ShouldBeNil)
+			So(body, ShouldEqual, `{"imei":"300234063904190","time":"2015-07-09T18:15:08Z","hex":"74657374206d65737361676530313233343536373839","lat":48.5,"lng":-11.25}`)
+			So(contentType, ShouldEqual, "application/vnd.tracker+json")
+		})
+		Convey("a target without a template should receive the JSON message", func() {
+			So(d.WithTargets(Targets{{IMEIPattern: ".*", Backend: b.URL}}), ShouldBeNil)
+			So(d.Handle(sampleBucket()), ShouldBeNil)
+			So(body, ShouldStartWith, `{"header":`)
+			So(contentType, ShouldEqual, "application/json")
+		})
+		Convey("a message which cannot be rendered should not be acknowledged", func() {
+			So(d.WithTargets(Targets{{IMEIPattern: ".*", Backend: b.URL, Template: `{{lat .Data.Position}}`}}), ShouldBeNil)
+			So(d.Handle(sampleBucket()), ShouldNotBeNil)
+			So(body, ShouldBeEmpty)
+		})
+		Convey("an invalid template should be rejected", func() {
+			So(d.WithTargets(Targets{{IMEIPattern: ".*", Backend: b.URL, Template: `{{base64 .Data.Payload`}}), ShouldNotBeNil)
+		})
+	})
+}
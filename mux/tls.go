@@ -0,0 +1,105 @@
+package mux
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// A TLSConfig configures the TLS connection to a webhook or a broker. The
+// files of a webhook are loaded again when they change, so renewed
+// certificates are used without a restart.
+type TLSConfig struct {
+	// CAFile contains the PEM encoded certificates which are trusted
+	// instead of the system roots.
+	CAFile string `yaml:"cafile,omitempty" json:"cafile,omitempty"`
+	// CertFile and KeyFile contain the client certificate and its key.
+	CertFile string `yaml:"certfile,omitempty" json:"certfile,omitempty"`
+	KeyFile  string `yaml:"keyfile,omitempty" json:"keyfile,omitempty"`
+	// MinVersion is the minimal TLS version, e.g. "1.2" or "1.3".
+	MinVersion string `yaml:"minversion,omitempty" json:"minversion,omitempty"`
+	// ServerName overrides the name which is sent with SNI and which is
+	// verified in the certificate of the server.
+	ServerName string `yaml:"servername,omitempty" json:"servername,omitempty"`
+}
+
+func (c *TLSConfig) validate() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("certfile and keyfile must be set together")
+	}
+	if _, ok := tlsVersions[c.MinVersion]; c.MinVersion != "" && !ok {
+		return fmt.Errorf("unknown tls version %q", c.MinVersion)
+	}
+	return nil
+}
+
+// files returns the files of the configuration.
+func (c *TLSConfig) files() []string {
+	var res []string
+	for _, f := range []string{c.CAFile, c.CertFile, c.KeyFile} {
+		if f != "" {
+			res = append(res, f)
+		}
+	}
+	return res
+}
+
+// fileState returns the size and modification time of the files, so a
+// change can be detected.
+func (c *TLSConfig) fileState() (string, error) {
+	if c == nil {
+		return "", nil
+	}
+	var b strings.Builder
+	for _, f := range c.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "%s:%d:%d;", f, fi.Size(), fi.ModTime().UnixNano())
+	}
+	return b.String(), nil
+}
+
+// load creates the tls configuration of a target. The configuration may
+// be nil, then only skipVerify is used.
+func (c *TLSConfig) load(skipVerify bool) (*tls.Config, error) {
+	cfg := &tls.Config{InsecureSkipVerify: skipVerify}
+	if c == nil {
+		return cfg, nil
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	cfg.MinVersion = tlsVersions[c.MinVersion]
+	cfg.ServerName = c.ServerName
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read ca file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %q", c.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
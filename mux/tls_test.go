@@ -0,0 +1,151 @@
+package mux
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert creates a certificate which is signed by the parent or self
+// signed if the parent is nil.
+func newTestCert(name string, parent *testCert, usage x509.ExtKeyUsage) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	signer, signerKey := tpl, key
+	if parent == nil {
+		tpl.IsCA = true
+		tpl.BasicConstraintsValid = true
+		tpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		panic(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) tls() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+// write stores the certificate and the key as PEM files.
+func (c *testCert) write(certFile, keyFile string) {
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0o600)
+	if keyFile != "" {
+		k, _ := x509.MarshalECPrivateKey(c.key)
+		os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: k}), 0o600)
+	}
+}
+
+func TestTLSTargets(t *testing.T) {
+	Convey("given a backend which requires a client certificate", t, func() {
+		ca := newTestCert("ca", nil, x509.ExtKeyUsageAny)
+		server := newTestCert("backend.internal", ca, x509.ExtKeyUsageServerAuth)
+		pool := x509.NewCertPool()
+		pool.AddCert(ca.cert)
+
+		b := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		b.TLS = &tls.Config{
+			Certificates: []tls.Certificate{server.tls()},
+			ClientCAs:    pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		}
+		b.StartTLS()
+		defer b.Close()
+
+		dir := t.TempDir()
+		cfg := &TLSConfig{
+			CAFile:     filepath.Join(dir, "ca.pem"),
+			CertFile:   filepath.Join(dir, "client.pem"),
+			KeyFile:    filepath.Join(dir, "client.key"),
+			MinVersion: "1.2",
+			ServerName: "backend.internal",
+		}
+		ca.write(cfg.CAFile, "")
+		newTestCert("client", ca, x509.ExtKeyUsageClientAuth).write(cfg.CertFile, cfg.KeyFile)
+
+		d := New(1, testLogger())
+		defer d.Close()
+
+		Convey("a target with the client certificate should deliver", func() {
+			So(d.WithTargets(Targets{{IMEIPattern: ".*", Backend: b.URL, TLS: cfg}}), ShouldBeNil)
+			So(d.Handle(sampleBucket()), ShouldBeNil)
+		})
+		Convey("a target without the client certificate should fail", func() {
+			So(d.WithTargets(Targets{{IMEIPattern: ".*", Backend: b.URL, TLS: &TLSConfig{CAFile: cfg.CAFile, ServerName: cfg.ServerName}}}), ShouldBeNil)
+			So(d.Handle(sampleBucket()), ShouldNotBeNil)
+		})
+		Convey("a changed client certificate should be used without a reconfiguration", func() {
+			other := newTestCert("other", nil, x509.ExtKeyUsageAny)
+			newTestCert("client", other, x509.ExtKeyUsageClientAuth).write(cfg.CertFile, cfg.KeyFile)
+			So(d.WithTargets(Targets{{IMEIPattern: ".*", Backend: b.URL, TLS: cfg}}), ShouldBeNil)
+			So(d.Handle(sampleBucket()), ShouldNotBeNil)
+
+			newTestCert("client", ca, x509.ExtKeyUsageClientAuth).write(cfg.CertFile, cfg.KeyFile)
+			// make sure the modification time differs on coarse file systems
+			later := time.Now().Add(time.Second)
+			os.Chtimes(cfg.CertFile, later, later)
+			So(d.Handle(sampleBucket()), ShouldBeNil)
+		})
+		Convey("a broker target should use the tls configuration", func() {
+			ms, err := newMQTTSink(&Target{Type: "mqtt", Backend: "ssl://localhost:8883", Topic: "sbd", TLS: cfg})
+			So(err, ShouldBeNil)
+			r := ms.client.OptionsReader()
+			So(r.TLSConfig().ServerName, ShouldEqual, "backend.internal")
+			So(r.TLSConfig().Certificates, ShouldHaveLength, 1)
+
+			ns, err := newNATSSink(&Target{Type: "nats", Backend: "tls://localhost:4222", Topic: "sbd", TLS: cfg})
+			So(err, ShouldBeNil)
+			var o nats.Options
+			for _, opt := range ns.opts {
+				So(opt(&o), ShouldBeNil)
+			}
+			So(o.Secure, ShouldBeTrue)
+			So(o.TLSConfig.ServerName, ShouldEqual, "backend.internal")
+		})
+	})
+	Convey("invalid tls configurations should be rejected", t, func() {
+		d := New(1, testLogger())
+		defer d.Close()
+		So(d.WithTargets(Targets{{IMEIPattern: ".*", Backend: "https://localhost", TLS: &TLSConfig{CertFile: "client.pem"}}}), ShouldNotBeNil)
+		So(d.WithTargets(Targets{{IMEIPattern: ".*", Backend: "https://localhost", TLS: &TLSConfig{MinVersion: "2.0"}}}), ShouldNotBeNil)
+		So(d.WithTargets(Targets{{IMEIPattern: ".*", Backend: "https://localhost", TLS: &TLSConfig{CAFile: "/does/not/exist"}}}), ShouldNotBeNil)
+		So(d.WithTargets(Targets{{IMEIPattern: ".*", Type: "mqtt", Backend: "ssl://localhost:8883", Topic: "sbd", TLS: &TLSConfig{CAFile: "/does/not/exist"}}}), ShouldNotBeNil)
+		So(d.WithTargets(Targets{{IMEIPattern: ".*", Type: "nats", Backend: "tls://localhost:4222", Topic: "sbd", TLS: &TLSConfig{CAFile: "/does/not/exist"}}}), ShouldNotBeNil)
+	})
+}
@@ -4,25 +4,29 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"time"
 )
 
 type Orientation byte
 type SessionStatus byte
 
+// An ElementID identifies the type of an information element.
 type ElementID byte
 
 const (
-	moHeaderID              = ElementID(0x01)
-	moPayloadID             = ElementID(0x02)
-	moLocationInformationID = ElementID(0x03)
-	moConfirmationID        = ElementID(0x05)
-	mtHeaderID              = ElementID(0x41)
-	mtPayloadID             = ElementID(0x42)
-	mtConfirmationMsg       = ElementID(0x44)
-	mtMessagePriority       = ElementID(0x46)
+	// Information elements of the directip protocol
+	MOHeaderID              = ElementID(0x01)
+	MOPayloadID             = ElementID(0x02)
+	MOLocationInformationID = ElementID(0x03)
+	MOConfirmationID        = ElementID(0x05)
+	MTHeaderID              = ElementID(0x41)
+	MTPayloadID             = ElementID(0x42)
+	MTConfirmationID        = ElementID(0x44)
+	MTPriorityID            = ElementID(0x46)
 
 	// SBD Session Status
 	StCompleted             = SessionStatus(0)
@@ -55,19 +59,40 @@ func (o Orientation) LatLng(lat, lng float64) (float64, float64) {
 	return lat, lng
 }
 
+func (eid ElementID) String() string {
+	switch eid {
+	case MOHeaderID:
+		return "MO header"
+	case MOPayloadID:
+		return "MO payload"
+	case MOLocationInformationID:
+		return "MO location information"
+	case MOConfirmationID:
+		return "MO confirmation"
+	case MTHeaderID:
+		return "MT header"
+	case MTPayloadID:
+		return "MT payload"
+	case MTConfirmationID:
+		return "MT confirmation"
+	case MTPriorityID:
+		return "MT message priority"
+	}
+	return fmt.Sprintf("unknown element %#02x", byte(eid))
+}
+
 func (eid ElementID) TargetType() interface{} {
 	switch eid {
-	case moPayloadID:
+	case MOPayloadID:
 		return &MOPayload{}
-	case moLocationInformationID:
+	case MOLocationInformationID:
 		return &MOLocationInformation{}
-	case moConfirmationID:
+	case MOConfirmationID:
 		return &MOConfirmationMessage{}
-	case moHeaderID:
-		fallthrough
-	default:
+	case MOHeaderID:
 		return &MODirectIPHeader{}
 	}
+	return &UnknownElement{ID: eid}
 }
 
 // A MessageHeader defines the revision and the whole message length.
@@ -125,6 +150,23 @@ type InformationBucket struct {
 	Payload  []byte                 `json:"payload"`
 	Location *MOLocationInformation `json:"location"`
 	Position *Location              `json:"position"`
+	Unknown  []UnknownElement       `json:"unknown,omitempty"`
+	raw      []byte
+}
+
+// Raw returns the message as it was received if the bucket was parsed
+// from a directip message, otherwise nil. The raw message is not updated
+// when the fields of the bucket are changed.
+func (b *InformationBucket) Raw() []byte {
+	return b.raw
+}
+
+// An UnknownElement contains the raw data of an information element which
+// is not known by this package, so newer or vendor specific elements are
+// not lost.
+type UnknownElement struct {
+	ID   ElementID `json:"id"`
+	Data []byte    `json:"data"`
 }
 
 // The MODirectIPHeader contains some information about the message
@@ -221,6 +263,54 @@ func (loc *MOLocationInformation) GetLatLng() (float64, float64) {
 	return loc.Position.OrientationCode.LatLng(la, ln)
 }
 
+// NewLocationInformation converts the given latitude/longitude values to
+// the degree/minute representation which is used by iridium. The minutes
+// are rounded to thousandths.
+func NewLocationInformation(lat, lng float64, cepRadius int) (*MOLocationInformation, error) {
+	if math.IsNaN(lat) || math.Abs(lat) > 90 {
+		return nil, fmt.Errorf("invalid latitude: %v", lat)
+	}
+	if math.IsNaN(lng) || math.Abs(lng) > 180 {
+		return nil, fmt.Errorf("invalid longitude: %v", lng)
+	}
+	if cepRadius < 0 || cepRadius > math.MaxUint32 {
+		return nil, fmt.Errorf("invalid cep radius: %d", cepRadius)
+	}
+	var o Orientation
+	switch {
+	case lat >= 0 && lng >= 0:
+		o = NE
+	case lat >= 0:
+		o = NW
+	case lng >= 0:
+		o = SE
+	default:
+		o = SW
+	}
+	latDeg, latMin := degreeMinutes(math.Abs(lat))
+	lngDeg, lngMin := degreeMinutes(math.Abs(lng))
+	return &MOLocationInformation{
+		Position: LocationData{
+			OrientationCode: o,
+			LatDegree:       latDeg,
+			LatMinute:       latMin,
+			LngDegree:       lngDeg,
+			LngMinute:       lngMin,
+		},
+		CEPRadius: uint32(cepRadius),
+	}, nil
+}
+
+func degreeMinutes(v float64) (byte, uint16) {
+	deg := math.Floor(v)
+	mins := math.Round((v - deg) * 60 * 1000)
+	if mins >= 60000 {
+		deg++
+		mins -= 60000
+	}
+	return byte(deg), uint16(mins)
+}
+
 // GetCEPRadius simply returns the radius as an int value
 func (loc *MOLocationInformation) GetCEPRadius() int {
 	return int(loc.CEPRadius)
@@ -232,63 +322,141 @@ func parseMessageHeader(in io.Reader) (*MessageHeader, error) {
 		if err == io.EOF {
 			return nil, err
 		}
-		return nil, fmt.Errorf("cannot read message header: %v", err)
+		return nil, fmt.Errorf("cannot read message header: %w", err)
 	}
 	return &res, nil
 }
 
-func parseInformationElement(in io.Reader) (*InformationElement, error) {
+// ParseOptions control how strict a message is parsed.
+type ParseOptions struct {
+	// Strict checks that the elements with a fixed size have the correct
+	// length, that every element occurs only once and that the message
+	// contains a MO header.
+	Strict bool
+}
+
+// A ParseErrorKind classifies a ParseError. The kinds are a small fixed
+// set, so they can be used e.g. as a metric label.
+type ParseErrorKind string
+
+// The kinds of a ParseError.
+const (
+	KindProtocolVersion  = ParseErrorKind("protocol_version")
+	KindTruncatedElement = ParseErrorKind("truncated_element")
+	KindElementLength    = ParseErrorKind("element_length")
+	KindInvalidElement   = ParseErrorKind("invalid_element")
+	KindDuplicateElement = ParseErrorKind("duplicate_element")
+	KindMissingHeader    = ParseErrorKind("missing_header")
+)
+
+// A ParseError is returned when a message cannot be parsed. The offset
+// is the position in the message including the message header, the ID is
+// the element which is invalid or zero if the message itself is invalid.
+type ParseError struct {
+	Offset int
+	ID     ElementID
+	Kind   ParseErrorKind
+	Reason string
+}
+
+func (e *ParseError) Error() string {
+	if e.ID == 0 {
+		return fmt.Sprintf("invalid message at offset %d: %s", e.Offset, e.Reason)
+	}
+	return fmt.Sprintf("invalid %s at offset %d: %s", e.ID, e.Offset, e.Reason)
+}
+
+// parseInformationElement parses the element at the beginning of the
+// buffer and returns the element and the number of consumed bytes. The
+// error is a *ParseError without offset and ID.
+func parseInformationElement(buf []byte, opts ParseOptions) (*InformationElement, int, *ParseError) {
 	var h Header
-	if err := binary.Read(in, binary.BigEndian, &h); err != nil {
-		if err == io.EOF {
-			return nil, err
+	hs := binary.Size(h)
+	if len(buf) < hs {
+		return nil, 0, &ParseError{Kind: KindTruncatedElement, Reason: fmt.Sprintf("%d trailing bytes", len(buf))}
+	}
+	if err := binary.Read(bytes.NewReader(buf), binary.BigEndian, &h); err != nil {
+		return nil, 0, &ParseError{Kind: KindTruncatedElement, Reason: fmt.Sprintf("cannot read informationelement header: %v", err)}
+	}
+	if int(h.ElementLength) > len(buf)-hs {
+		return nil, 0, &ParseError{Kind: KindTruncatedElement, Reason: fmt.Sprintf("element length %d exceeds the remaining %d bytes", h.ElementLength, len(buf)-hs)}
+	}
+	if opts.Strict {
+		switch h.ID {
+		case MOHeaderID, MOLocationInformationID, MOConfirmationID:
+			if sz := binary.Size(h.ID.TargetType()); sz != int(h.ElementLength) {
+				return nil, 0, &ParseError{Kind: KindElementLength, Reason: fmt.Sprintf("element length must be %d, not %d", sz, h.ElementLength)}
+			}
 		}
-		return nil, fmt.Errorf("cannot read informationelement header: %v", err)
 	}
-	el, err := parseElementByType(&h, in)
+	el, err := parseElementByType(&h, bytes.NewReader(buf[hs:hs+int(h.ElementLength)]))
 	if err != nil {
-		return nil, err
+		return nil, 0, &ParseError{Kind: KindInvalidElement, Reason: err.Error()}
 	}
 
-	return &InformationElement{Header: h, Data: el}, nil
+	return &InformationElement{Header: h, Data: el}, hs + int(h.ElementLength), nil
 }
 
 // GetElements parses the given stream and returns an array of found
 // elements.
 func GetElements(in io.Reader) (*InformationBucket, error) {
+	return ParseElements(in, ParseOptions{})
+}
+
+// ParseElements is like GetElements but parses the message with the given
+// options. Invalid elements are reported with a *ParseError.
+func ParseElements(in io.Reader, opts ParseOptions) (*InformationBucket, error) {
 	mh, err := parseMessageHeader(in)
 	if err != nil {
 		return nil, err
 	}
 	if mh.ProtocolRevision != protocolRevision {
-		return nil, fmt.Errorf("wrong protocol version: %d", mh.ProtocolRevision)
+		return nil, &ParseError{Kind: KindProtocolVersion, Reason: fmt.Sprintf("wrong protocol version: %d", mh.ProtocolRevision)}
 	}
-	bbuf := make([]byte, mh.MessageLength)
+	offset := binary.Size(mh)
+	raw := make([]byte, offset+int(mh.MessageLength))
+	raw[0] = mh.ProtocolRevision
+	binary.BigEndian.PutUint16(raw[1:offset], mh.MessageLength)
+	bbuf := raw[offset:]
 	_, err = io.ReadFull(in, bbuf)
 	if err != nil {
-		return nil, fmt.Errorf("cannot read bytes from message: %v", err)
+		return nil, fmt.Errorf("cannot read bytes from message: %w", err)
 	}
-	buffer := bytes.NewBuffer(bbuf)
-	buck := new(InformationBucket)
-	for {
-		ie, err := parseInformationElement(buffer)
-		if err == io.EOF {
-			break
+	seen := make(map[ElementID]bool)
+	buck := &InformationBucket{raw: raw}
+	for len(bbuf) > 0 {
+		ie, n, pe := parseInformationElement(bbuf, opts)
+		if pe != nil {
+			pe.Offset = offset
+			if len(bbuf) >= binary.Size(Header{}) {
+				pe.ID = ElementID(bbuf[0])
+			}
+			return nil, pe
 		}
-		if err != nil {
-			return nil, err
+		if opts.Strict && seen[ie.ID] {
+			return nil, &ParseError{Offset: offset, ID: ie.ID, Kind: KindDuplicateElement, Reason: "duplicate element"}
 		}
+		seen[ie.ID] = true
+		bbuf = bbuf[n:]
+		offset += n
 		switch ie.ID {
-		case moPayloadID:
+		case MOPayloadID:
 			buck.Payload = ie.Data.(*MOPayload).Payload
-		case moHeaderID:
+		case MOHeaderID:
 			buck.Header = ie.Data.(*MODirectIPHeader)
-		case moLocationInformationID:
+		case MOLocationInformationID:
 			buck.Location = ie.Data.(*MOLocationInformation)
 			lat, lng := buck.Location.GetLatLng()
 			buck.Position = &Location{Latitude: lat, Longitude: lng}
+		case MOConfirmationID:
+			// a confirmation is never sent by the gateway, so we ignore it
+		default:
+			buck.Unknown = append(buck.Unknown, *ie.Data.(*UnknownElement))
 		}
 	}
+	if opts.Strict && buck.Header == nil {
+		return nil, &ParseError{Offset: offset, Kind: KindMissingHeader, Reason: "missing MO header"}
+	}
 
 	return buck, nil
 }
@@ -297,28 +465,107 @@ func parseElementByType(h *Header, in io.Reader) (interface{}, error) {
 	buf := h.ID.TargetType()
 
 	// we cannot read the payload struct with binary.Read because it has
-	// a byte-slice as field. so we must do it the ugly way here.
-	if h.ID == moPayloadID {
+	// a byte-slice as field. so we must do it the ugly way here. the same
+	// is true for unknown elements where we keep the raw data.
+	unknown, isUnknown := buf.(*UnknownElement)
+	if h.ID == MOPayloadID || isUnknown {
 		buf = make([]byte, h.ElementLength)
 	}
 	if err := binary.Read(in, binary.BigEndian, buf); err != nil {
-		if err == io.EOF {
-			return nil, err
-		}
 		return nil, fmt.Errorf("cannot read informationelement content: %v", err)
 	}
-	if h.ID == moPayloadID {
+	if h.ID == MOPayloadID {
 		return &MOPayload{Payload: buf.([]byte)}, nil
 	}
+	if isUnknown {
+		unknown.Data = buf.([]byte)
+		return unknown, nil
+	}
 
 	return buf, nil
 }
 
+// Marshal returns the bucket encoded as a directip MO message.
+func Marshal(b *InformationBucket) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := b.Encode(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Encode writes the bucket as a directip MO message to the given writer.
+// The information elements are written in the same order as the iridium
+// gateway does: header, location and payload followed by the unknown
+// elements. If the bucket has no Location but a Position, the location
+// element is computed from the Position.
+func (b *InformationBucket) Encode(w io.Writer) error {
+	if b.Header == nil {
+		return errors.New("cannot encode message without MO header")
+	}
+	var body bytes.Buffer
+	if err := writeElement(&body, MOHeaderID, b.Header); err != nil {
+		return err
+	}
+	loc := b.Location
+	if loc == nil && b.Position != nil {
+		l, err := NewLocationInformation(b.Position.Latitude, b.Position.Longitude, 0)
+		if err != nil {
+			return err
+		}
+		loc = l
+	}
+	if loc != nil {
+		if err := writeElement(&body, MOLocationInformationID, loc); err != nil {
+			return err
+		}
+	}
+	if b.Payload != nil {
+		if err := writeElement(&body, MOPayloadID, b.Payload); err != nil {
+			return err
+		}
+	}
+	for _, u := range b.Unknown {
+		if err := writeElement(&body, u.ID, u.Data); err != nil {
+			return err
+		}
+	}
+	if body.Len() > math.MaxUint16 {
+		return fmt.Errorf("the message is to large (%d)", body.Len())
+	}
+	mh := MessageHeader{
+		ProtocolRevision: protocolRevision,
+		MessageLength:    uint16(body.Len()),
+	}
+	if err := binary.Write(w, binary.BigEndian, &mh); err != nil {
+		return fmt.Errorf("cannot write message header: %v", err)
+	}
+	if _, err := w.Write(body.Bytes()); err != nil {
+		return fmt.Errorf("cannot write message: %v", err)
+	}
+	return nil
+}
+
+func writeElement(w io.Writer, id ElementID, data interface{}) error {
+	sz := binary.Size(data)
+	if sz < 0 || sz > math.MaxUint16 {
+		return fmt.Errorf("cannot encode informationelement %#x with size %d", byte(id), sz)
+	}
+	h := Header{ID: id, ElementLength: uint16(sz)}
+	if err := binary.Write(w, binary.BigEndian, &h); err != nil {
+		return fmt.Errorf("cannot write informationelement header: %v", err)
+	}
+	if err := binary.Write(w, binary.BigEndian, data); err != nil {
+		return fmt.Errorf("cannot write informationelement content: %v", err)
+	}
+	return nil
+}
+
 // NewPayload returns an element which contains the given bytes as payload.
 func NewPayload(b []byte) *InformationElement {
 	return &InformationElement{
 		Header: Header{
-			ID:            moPayloadID,
+			ID:            MOPayloadID,
 			ElementLength: uint16(len(b)),
 		},
 		Data: &MOPayload{
@@ -2,6 +2,8 @@ package sbd
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"testing"
 
 	. "github.com/smartystreets/goconvey/convey"
@@ -149,3 +151,112 @@ func TestOrientation(t *testing.T) {
 		})
 	})
 }
+
+func TestMarshal(t *testing.T) {
+	msgs := []struct {
+		Name string
+		Msg  string
+	}{
+		{Name: "sample1", Msg: sample_msg1},
+		{Name: "sample2", Msg: sample_msg2},
+		{Name: "sample3", Msg: sample_msg3},
+	}
+	for _, msg := range msgs {
+		Convey("Parsing "+msg.Name, t, func() {
+			el, err := GetElements(bytes.NewBufferString(msg.Msg))
+			So(err, ShouldBeNil)
+			Convey("The encoded message should be identical", func() {
+				data, err := Marshal(el)
+				So(err, ShouldBeNil)
+				So(string(data), ShouldEqual, msg.Msg)
+			})
+		})
+	}
+	Convey("Given a bucket with a position only", t, func() {
+		el, err := GetElements(bytes.NewBufferString(sample_msg3))
+		So(err, ShouldBeNil)
+		el.Position = &Location{Latitude: -6.600967, Longitude: 138.5077}
+		Convey("The location should be encoded in degrees and minutes", func() {
+			data, err := Marshal(el)
+			So(err, ShouldBeNil)
+			res, err := GetElements(bytes.NewBuffer(data))
+			So(err, ShouldBeNil)
+			So(res.Location, ShouldNotBeNil)
+			So(res.Location.Position.OrientationCode, ShouldEqual, SE)
+			lat, lng := res.Location.GetLatLng()
+			So(lat, ShouldAlmostEqual, -6.600967, .00001)
+			So(lng, ShouldAlmostEqual, 138.5077, .00001)
+			So(res.Payload, ShouldResemble, el.Payload)
+		})
+	})
+	Convey("Given a bucket without a header", t, func() {
+		_, err := Marshal(&InformationBucket{Payload: []byte("test")})
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestUnknownElement(t *testing.T) {
+	// sample3 with an additional element 0x09 between header and payload
+	msg := "\x01\x00\x3e\x01\x00\x1cp\xec\ai300234063904190\x00\x00K\x00\x00U\x9e\xba,\x09\x00\x03abc\x02\x00\x16test message0123456789"
+	Convey("Loading a message with an unknown element", t, func() {
+		el, err := GetElements(bytes.NewBufferString(msg))
+		So(err, ShouldBeNil)
+		Convey("The known elements should be parsed", func() {
+			So(el.Header, ShouldNotBeNil)
+			So(el.Header.GetIMEI(), ShouldEqual, "300234063904190")
+			So(el.Payload, ShouldResemble, []byte("test message0123456789"))
+		})
+		Convey("The unknown element should be kept", func() {
+			So(el.Unknown, ShouldResemble, []UnknownElement{{ID: 0x09, Data: []byte("abc")}})
+		})
+		Convey("The unknown element should be part of the JSON", func() {
+			js, err := json.Marshal(el)
+			So(err, ShouldBeNil)
+			var res InformationBucket
+			So(json.Unmarshal(js, &res), ShouldBeNil)
+			So(res.Unknown, ShouldResemble, el.Unknown)
+		})
+		Convey("The raw message should be kept unchanged", func() {
+			So(string(el.Raw()), ShouldEqual, msg)
+			enc, err := Marshal(el)
+			So(err, ShouldBeNil)
+			So(string(enc), ShouldNotEqual, msg)
+		})
+	})
+}
+
+func TestStrictParsing(t *testing.T) {
+	msgs := []struct {
+		Name   string
+		Msg    string
+		Offset int
+		ID     ElementID
+		Kind   ParseErrorKind
+	}{
+		// sample3 with a header length of 29
+		{Name: "wrong header length", Msg: "\x01\x009\x01\x00\x1dp\xec\ai300234063904190\x00\x00K\x00\x00U\x9e\xba,\x00\x02\x00\x16test message0123456789", Offset: 3, ID: MOHeaderID, Kind: KindElementLength},
+		// sample3 without the header
+		{Name: "missing header", Msg: "\x01\x00\x19\x02\x00\x16test message0123456789", Offset: 28, Kind: KindMissingHeader},
+		// sample3 with two payloads
+		{Name: "duplicate payload", Msg: "\x01\x00\x3b\x01\x00\x1cp\xec\ai300234063904190\x00\x00K\x00\x00U\x9e\xba,\x02\x00\x16test message0123456789\x02\x00\x00", Offset: 59, ID: MOPayloadID, Kind: KindDuplicateElement},
+		// sample3 with two trailing bytes
+		{Name: "trailing bytes", Msg: "\x01\x00\x3a\x01\x00\x1cp\xec\ai300234063904190\x00\x00K\x00\x00U\x9e\xba,\x02\x00\x16test message0123456789\x00\x00", Offset: 59, Kind: KindTruncatedElement},
+	}
+	for _, msg := range msgs {
+		Convey("Parsing a message with "+msg.Name+" strictly", t, func() {
+			_, err := ParseElements(bytes.NewBufferString(msg.Msg), ParseOptions{Strict: true})
+			Convey("should return a parse error", func() {
+				var pe *ParseError
+				So(errors.As(err, &pe), ShouldBeTrue)
+				So(pe.Offset, ShouldEqual, msg.Offset)
+				So(pe.ID, ShouldEqual, msg.ID)
+				So(pe.Kind, ShouldEqual, msg.Kind)
+			})
+		})
+	}
+	Convey("Parsing a valid message strictly", t, func() {
+		el, err := ParseElements(bytes.NewBufferString(sample_msg1), ParseOptions{Strict: true})
+		So(err, ShouldBeNil)
+		So(el.Location, ShouldNotBeNil)
+	})
+}
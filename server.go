@@ -1,11 +1,14 @@
 package sbd
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
+	"sync"
 	"time"
 
 	proxyproto "github.com/pires/go-proxyproto"
@@ -13,8 +16,14 @@ import (
 
 const (
 	deadline = 30 * time.Second
+
+	maxAcceptDelay = 1 * time.Second
 )
 
+// ErrServerClosed is returned by the Server's Serve and ListenAndServe methods
+// after a call to Shutdown.
+var ErrServerClosed = errors.New("sbd: Server closed")
+
 // A Handler is called by the service when a new *Short Burst Data* packet
 // comes in. The handler will get an *InformationBucket* where all the packet data
 // is bundled. If this handler returns nil, the server will send a positiv
@@ -51,56 +60,211 @@ type result struct {
 }
 
 func createResult(status byte) *result {
-	return &result{MessageHeader: MessageHeader{ProtocolRevision: protocolRevision, MessageLength: 4}, Header: Header{ID: moConfirmationID, ElementLength: 1}, MOConfirmationMessage: MOConfirmationMessage{Status: status}}
+	return &result{MessageHeader: MessageHeader{ProtocolRevision: protocolRevision, MessageLength: 4}, Header: Header{ID: MOConfirmationID, ElementLength: 1}, MOConfirmationMessage: MOConfirmationMessage{Status: status}}
 }
 
-// NewService starts a listener on the given *address* and dispatches every
-// short burst data packet to the given handler. If the handler returns a
-// non-nil error, the service will send a negative response, otherwise the
-// responsestatus will be ok.
-func NewService(log *slog.Logger, address string, h Handler, proxyprotocol bool) error {
-	l, err := net.Listen("tcp", address)
+// A Server accepts directip connections from the iridium gateway and
+// dispatches every short burst data packet to its Handler. If the handler
+// returns a non-nil error, the server will send a negative response,
+// otherwise the responsestatus will be ok.
+//
+// A Server can be stopped gracefully with Shutdown, so packets which are
+// already received will be handled and acknowledged.
+type Server struct {
+	// Addr is the tcp address used by ListenAndServe.
+	Addr string
+	// Handler is called for every received packet.
+	Handler Handler
+	// Log is used for logging, if nil the default logger is used.
+	Log *slog.Logger
+	// ProxyProtocol wraps the listener of ListenAndServe so the
+	// proxy protocol header is parsed.
+	ProxyProtocol bool
+	// ParseOptions are used to parse the incoming messages.
+	ParseOptions ParseOptions
+	// OnAccept is called for every accepted connection if not nil.
+	OnAccept func(net.Conn)
+	// OnParseError is called if a message cannot be parsed if not nil.
+	OnParseError func(error)
+
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{}
+	conns      sync.WaitGroup
+	inShutdown bool
+}
+
+// ListenAndServe listens on the tcp address s.Addr and calls Serve.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	l, err := net.Listen("tcp", s.Addr)
 	if err != nil {
-		return fmt.Errorf("cannot open listening address %q: %v", address, err)
+		return fmt.Errorf("cannot open listening address %q: %v", s.Addr, err)
 	}
-	if proxyprotocol {
+	if s.ProxyProtocol {
 		l = &proxyproto.Listener{Listener: l, ReadHeaderTimeout: 10 * time.Second}
 	}
-	defer l.Close()
+	return s.Serve(ctx, l)
+}
+
+// Serve accepts incoming connections on the listener and handles every
+// connection in a new goroutine. Serve always closes the listener. After
+// Shutdown it returns ErrServerClosed; when the given context is done,
+// the server stops accepting, waits for the running connections and
+// returns the error of the context.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	if !s.trackListener(l, true) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(l, false)
+
+	stop := context.AfterFunc(ctx, func() { l.Close() })
+	defer stop()
+
+	var delay time.Duration
 	for {
 		// Wait for a connection.
 		conn, err := l.Accept()
 		if err != nil {
-			log.Error("cannot accept", "error", err)
-			// let it crash! it's up to the caller of the prog to restart it
-			panic(err)
-		}
-
-		go func(c net.Conn) {
-			// directip connects, sends message and closes connection, so no whilte loop is needed
-			// to read more than one message from the connection
-			defer c.Close()
-
-			// set a deadline so we do not run out of connections
-			c.SetDeadline(time.Now().Add(deadline))
-
-			log.Info("new connection")
-			el, err := GetElements(c)
-			res := createResult(0)
-			if err != nil {
-				log.Error("cannot get elements from connection", "error", err)
-				binary.Write(c, binary.BigEndian, res)
-				return
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			if ctx.Err() != nil {
+				s.conns.Wait()
+				return ctx.Err()
 			}
-			log.Info("received data", "elements", el)
-			err = h.Handle(el)
-			if err != nil {
-				log.Error("error handling message", "error", err)
-			} else {
-				res.Status = 1
+			if errors.Is(err, net.ErrClosed) {
+				return err
 			}
-			log.Info("write response", "result", res)
-			binary.Write(c, binary.BigEndian, res)
+			// most likely we are out of file descriptors, so try again later
+			delay = min(max(2*delay, 5*time.Millisecond), maxAcceptDelay)
+			s.logger().Error("cannot accept", "error", err, "retry", delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		if !s.trackConn() {
+			conn.Close()
+			continue
+		}
+		if s.OnAccept != nil {
+			s.OnAccept(conn)
+		}
+		go func(c net.Conn) {
+			defer s.conns.Done()
+			s.serveConn(c)
 		}(conn)
 	}
 }
+
+// Shutdown stops the server gracefully. All listeners are closed and
+// Shutdown waits until every active connection has been handled and
+// acknowledged. If the context is done before, its error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.inShutdown = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.conns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Server) logger() *slog.Logger {
+	if s.Log != nil {
+		return s.Log
+	}
+	return slog.Default()
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inShutdown
+}
+
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.listeners, l)
+		return true
+	}
+	if s.inShutdown {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+// trackConn registers a new connection. It must be done under the lock,
+// so Shutdown will never wait for a connection which is added later.
+func (s *Server) trackConn() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inShutdown {
+		return false
+	}
+	s.conns.Add(1)
+	return true
+}
+
+func (s *Server) serveConn(c net.Conn) {
+	// directip connects, sends message and closes connection, so no whilte loop is needed
+	// to read more than one message from the connection
+	defer c.Close()
+	log := s.logger()
+
+	// set a deadline so we do not run out of connections
+	c.SetDeadline(time.Now().Add(deadline))
+
+	log.Info("new connection")
+	el, err := ParseElements(c, s.ParseOptions)
+	res := createResult(0)
+	if err != nil {
+		log.Error("cannot get elements from connection", "error", err)
+		if s.OnParseError != nil {
+			s.OnParseError(err)
+		}
+		binary.Write(c, binary.BigEndian, res)
+		return
+	}
+	log.Info("received data", "elements", el)
+	err = s.Handler.Handle(el)
+	if err != nil {
+		log.Error("error handling message", "error", err)
+	} else {
+		res.Status = 1
+	}
+	log.Info("write response", "result", res)
+	binary.Write(c, binary.BigEndian, res)
+}
+
+// NewService starts a listener on the given *address* and dispatches every
+// short burst data packet to the given handler. If the handler returns a
+// non-nil error, the service will send a negative response, otherwise the
+// responsestatus will be ok.
+//
+// Deprecated: NewService blocks forever and cannot be stopped, use a Server.
+func NewService(log *slog.Logger, address string, h Handler, proxyprotocol bool) error {
+	s := &Server{
+		Addr:          address,
+		Handler:       h,
+		Log:           log,
+		ProxyProtocol: proxyprotocol,
+	}
+	return s.ListenAndServe(context.Background())
+}
@@ -0,0 +1,73 @@
+package sbd
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestServerShutdown(t *testing.T) {
+	Convey("given a running server with a blocking handler", t, func() {
+		started := make(chan struct{})
+		release := make(chan struct{})
+		srv := &Server{
+			Handler: HandlerFunc(func(data *InformationBucket) error {
+				close(started)
+				<-release
+				return nil
+			}),
+		}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		served := make(chan error, 1)
+		go func() { served <- srv.Serve(context.Background(), l) }()
+
+		c, err := net.Dial("tcp", l.Addr().String())
+		So(err, ShouldBeNil)
+		defer c.Close()
+		_, err = c.Write([]byte(sample_msg3))
+		So(err, ShouldBeNil)
+		<-started
+
+		Convey("shutdown should wait for the running handler", func() {
+			stopped := make(chan error, 1)
+			go func() { stopped <- srv.Shutdown(context.Background()) }()
+			So(<-served, ShouldEqual, ErrServerClosed)
+
+			select {
+			case <-stopped:
+				t.Fatal("shutdown returned before the handler finished")
+			case <-time.After(50 * time.Millisecond):
+			}
+			close(release)
+
+			var res result
+			So(binary.Read(c, binary.BigEndian, &res), ShouldBeNil)
+			So(res.Success(), ShouldBeTrue)
+			So(<-stopped, ShouldBeNil)
+
+			_, err := net.Dial("tcp", l.Addr().String())
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestServerContext(t *testing.T) {
+	Convey("given a running server", t, func() {
+		srv := &Server{Handler: HandlerFunc(func(data *InformationBucket) error { return nil })}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		ctx, cancel := context.WithCancel(context.Background())
+		served := make(chan error, 1)
+		go func() { served <- srv.Serve(ctx, l) }()
+
+		Convey("cancelling the context should stop serving", func() {
+			cancel()
+			So(<-served, ShouldEqual, context.Canceled)
+		})
+	})
+}